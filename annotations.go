@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	ANNOTATION_ERROR   = "error"
+	ANNOTATION_WARNING = "warning"
+	ANNOTATION_NOTICE  = "notice"
+
+	// The records of the groups of lines opened and closed by the targets.
+	STREAM_GROUP    = "group"
+	STREAM_ENDGROUP = "endgroup"
+
+	ANNOTATIONS_MAX_REPORTED = 50
+
+	// The hidden first line of the comments reporting annotations, which
+	// tells them apart from the other comments of a commit.
+	ANNOTATIONS_COMMENT_MARKER = "<!-- jarvis-ci annotations -->"
+)
+
+var (
+	AnnotationComments bool
+)
+
+func init() {
+	flag.BoolVar(&AnnotationComments, "annotation-comments", true, "Whether to report the annotations of files in a comment on the commit")
+}
+
+// Annotation is a message of a target about the build, optionally about a
+// line of a file of the repository.
+type Annotation struct {
+	Target  string `json:"target"`
+	Level   string `json:"level"`
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Title   string `json:"title,omitempty"`
+	Message string `json:"message"`
+}
+
+// Location returns file:line:column, as far as they are known.
+func (a Annotation) Location() string {
+	location := a.File
+	if a.File != "" && a.Line > 0 {
+		location += ":" + strconv.Itoa(a.Line)
+		if a.Column > 0 {
+			location += ":" + strconv.Itoa(a.Column)
+		}
+	}
+	return location
+}
+
+func (a Annotation) String() string {
+	s := a.Level + ": "
+	if location := a.Location(); location != "" {
+		s += location + ": "
+	}
+	if a.Title != "" {
+		s += a.Title + ": "
+	}
+	return s + a.Message
+}
+
+// outputCommand is a control line written by a target, such as
+// ::error file=main.go,line=12::message.
+type outputCommand struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+var outputCommandPattern = regexp.MustCompile(`^\s*::(group|endgroup|error|warning|notice)( [^:]*)?::(.*)$`)
+
+// parseOutputCommand returns the command of the line, if it is one.
+func parseOutputCommand(line string) (outputCommand, bool) {
+	match := outputCommandPattern.FindStringSubmatch(line)
+	if match == nil {
+		return outputCommand{}, false
+	}
+
+	command := outputCommand{match[1], map[string]string{}, unescapeCommand(match[3], false)}
+	for _, param := range strings.Split(strings.TrimSpace(match[2]), ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) == 2 {
+			command.Params[strings.TrimSpace(kv[0])] = unescapeCommand(strings.TrimSpace(kv[1]), true)
+		}
+	}
+	return command, true
+}
+
+// unescapeCommand decodes the characters that cannot appear as is in a
+// command, along with the separators of its parameters.
+func unescapeCommand(s string, param bool) string {
+	replacements := []string{"%0D", "\r", "%0A", "\n"}
+	if param {
+		replacements = append(replacements, "%3A", ":", "%2C", ",")
+	}
+	return strings.NewReplacer(append(replacements, "%25", "%")...).Replace(s)
+}
+
+// annotation returns the annotation of an error, warning or notice command.
+func (c outputCommand) annotation(target string) Annotation {
+	a := Annotation{Target: target, Level: c.Name, Message: c.Value}
+	a.File = c.Params["file"]
+	a.Title = c.Params["title"]
+	a.Line, _ = strconv.Atoi(c.Params["line"])
+	a.Column, _ = strconv.Atoi(c.Params["col"])
+	return a
+}
+
+// annotationsComment returns the body of the comment reporting the
+// annotations of files of the job, empty if there are none.
+func annotationsComment(job *Job) string {
+	annotations := []Annotation{}
+	for _, a := range job.Annotations {
+		if a.File != "" {
+			annotations = append(annotations, a)
+		}
+	}
+	if len(annotations) == 0 {
+		return ""
+	}
+
+	body := &bytes.Buffer{}
+	fmt.Fprintf(body, "%s\njarvis-ci reported %d annotations for job [%s](%s):\n\n", ANNOTATIONS_COMMENT_MARKER, len(annotations), job.ID, job.OutputURL)
+	for i, a := range annotations {
+		if i == ANNOTATIONS_MAX_REPORTED {
+			fmt.Fprintf(body, "- and %d more\n", len(annotations)-i)
+			break
+		}
+		link := fmt.Sprintf("https://github.com/%s/blob/%s/%s", job.Repo, job.Commit, strings.TrimPrefix(a.File, "/"))
+		if a.Line > 0 {
+			link += fmt.Sprintf("#L%d", a.Line)
+		}
+		message := strings.Replace(a.Message, "\n", " ", -1)
+		if a.Title != "" {
+			message = a.Title + ": " + message
+		}
+		fmt.Fprintf(body, "- **%s** [%s](%s) in `%s`: %s\n", a.Level, a.Location(), link, a.Target, message)
+	}
+	return body.String()
+}
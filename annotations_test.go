@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOutputCommand(t *testing.T) {
+	_, ok := parseOutputCommand("go test ./...")
+	assert.False(t, ok)
+
+	command, ok := parseOutputCommand("::group::Unit tests")
+	assert.True(t, ok)
+	assert.Equal(t, "group", command.Name)
+	assert.Equal(t, "Unit tests", command.Value)
+
+	command, ok = parseOutputCommand("::error file=cmd/main.go,line=12,col=3,title=Build%3A vet::unused%0Avariable x")
+	assert.True(t, ok)
+	assert.Equal(t, Annotation{
+		Target:  "test",
+		Level:   ANNOTATION_ERROR,
+		File:    "cmd/main.go",
+		Line:    12,
+		Column:  3,
+		Title:   "Build: vet",
+		Message: "unused\nvariable x",
+	}, command.annotation("test"))
+}
+
+func TestAnnotationsComment(t *testing.T) {
+	job := NewJob(TRIGGER_PUSH)
+	job.Repo, job.Commit = "owner/repo", "abc"
+	job.AddAnnotation(Annotation{Target: "test", Level: ANNOTATION_NOTICE, Message: "no file"})
+	assert.Equal(t, "", annotationsComment(job))
+
+	job.AddAnnotation(Annotation{Target: "test", Level: ANNOTATION_WARNING, File: "main.go", Line: 4, Message: "deprecated"})
+	comment := annotationsComment(job)
+	assert.Contains(t, comment, "reported 1 annotations")
+	assert.Contains(t, comment, "- **warning** [main.go:4](https://github.com/owner/repo/blob/abc/main.go#L4) in `test`: deprecated")
+}
+
+func TestWriteLineMasksAnnotations(t *testing.T) {
+	h := &eventHandler{outputhandler: NewOutputHandler(10)}
+	h.values = func() []string { return []string{"hunter2-pass"} }
+	job := NewJob(TRIGGER_PUSH)
+	h.writeLine(job, "test", nil, STREAM_STDOUT, "::warning title=hunter2-pass::password is hunter2-pass")
+	assert.Equal(t, "***", job.Annotations[0].Title)
+	assert.Equal(t, "password is ***", job.Annotations[0].Message)
+
+	problems, err := newProblemMatchers(BuiltinMatchers, "test", "")
+	assert.Nil(t, err)
+	h.writeLine(job, "test", problems, STREAM_STDOUT, "main.go:3: bad token hunter2-pass")
+	assert.Equal(t, "bad token ***", job.Annotations[1].Message)
+}
+
+func TestReportAnnotationsOnce(t *testing.T) {
+	// The comments are listed a page at a time
+	comments := []map[string]string{{"body": "Looks good"}, {"body": "Ship it"}}
+	gets := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/repos/owner/repo/commits/abc/comments", req.URL.Path)
+		if req.Method == "POST" {
+			comment := map[string]string{}
+			json.NewDecoder(req.Body).Decode(&comment)
+			comments = append(comments, comment)
+			json.NewEncoder(w).Encode(comment)
+			return
+		}
+		gets++
+		page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+		if page == 0 {
+			page = 1
+		}
+		if page < len(comments) {
+			next := *req.URL
+			next.RawQuery = fmt.Sprintf("page=%d", page+1)
+			w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.String()))
+		}
+		json.NewEncoder(w).Encode(comments[page-1 : page])
+	}))
+	defer server.Close()
+
+	defer func(enabled bool) { AnnotationComments = enabled }(AnnotationComments)
+	AnnotationComments = true
+	h := &eventHandler{client: NewGithubClient("token", "")}
+	h.client.Client.BaseURL, _ = url.Parse(server.URL + "/")
+
+	job := NewJob(TRIGGER_PUSH)
+	job.Repo, job.Commit = "owner/repo", "abc"
+	job.AddAnnotation(Annotation{Target: "test", Level: ANNOTATION_WARNING, File: "main.go", Message: "deprecated"})
+	h.reportAnnotations(job)
+	assert.Equal(t, 3, len(comments))
+	assert.Equal(t, 2, gets)
+	assert.True(t, strings.HasPrefix(comments[2]["body"], ANNOTATIONS_COMMENT_MARKER))
+	assert.Contains(t, comments[2]["body"], "main.go")
+
+	// Listing stops at the comment of an earlier build
+	comments = []map[string]string{{"body": "Looks good"}, comments[2], {"body": "Ship it"}}
+	gets = 0
+	h.reportAnnotations(job)
+	assert.Equal(t, 3, len(comments))
+	assert.Equal(t, 2, gets)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ansiEscape matches the escape sequences of terminals: CSI sequences, such
+// as colors and cursor movements, and OSC sequences, such as titles.
+var ansiEscape = regexp.MustCompile(`\x1b(\[[0-9;?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)?|[@-Z\\-_])`)
+
+// StripANSI removes the escape sequences from the text.
+func StripANSI(s string) string {
+	return ansiEscape.ReplaceAllString(s, "")
+}
+
+// ansiStyle is the graphic rendition set by SGR sequences.
+type ansiStyle struct {
+	bold      bool
+	dim       bool
+	italic    bool
+	underline bool
+	fg        string
+	bg        string
+}
+
+// ansiRenderer renders lines with escape sequences as HTML. The style
+// carries over from one line to the next, as in a terminal.
+type ansiRenderer struct {
+	style ansiStyle
+}
+
+// Render returns the line as escaped HTML, colored text in spans.
+func (r *ansiRenderer) Render(line string) template.HTML {
+	out := &bytes.Buffer{}
+	last := 0
+	for _, loc := range ansiEscape.FindAllStringIndex(line, -1) {
+		r.write(out, line[last:loc[0]])
+		seq := line[loc[0]:loc[1]]
+		if strings.HasPrefix(seq, "\x1b[") && strings.HasSuffix(seq, "m") {
+			r.apply(strings.TrimSuffix(strings.TrimPrefix(seq, "\x1b["), "m"))
+		}
+		last = loc[1]
+	}
+	r.write(out, line[last:])
+	return template.HTML(out.String())
+}
+
+func (r *ansiRenderer) write(out *bytes.Buffer, text string) {
+	if text == "" {
+		return
+	}
+	classes, styles := []string{}, []string{}
+	s := r.style
+	if s.bold {
+		classes = append(classes, "ansi-bold")
+	}
+	if s.dim {
+		classes = append(classes, "ansi-dim")
+	}
+	if s.italic {
+		classes = append(classes, "ansi-italic")
+	}
+	if s.underline {
+		classes = append(classes, "ansi-underline")
+	}
+	for _, color := range []struct{ value, prefix, property string }{{s.fg, "ansi-fg-", "color"}, {s.bg, "ansi-bg-", "background-color"}} {
+		if strings.HasPrefix(color.value, "#") {
+			styles = append(styles, color.property+":"+color.value)
+		} else if color.value != "" {
+			classes = append(classes, color.prefix+color.value)
+		}
+	}
+
+	if len(classes) == 0 && len(styles) == 0 {
+		out.WriteString(html.EscapeString(text))
+		return
+	}
+	out.WriteString("<span")
+	if len(classes) > 0 {
+		fmt.Fprintf(out, ` class="%s"`, strings.Join(classes, " "))
+	}
+	if len(styles) > 0 {
+		fmt.Fprintf(out, ` style="%s"`, strings.Join(styles, ";"))
+	}
+	fmt.Fprintf(out, ">%s</span>", html.EscapeString(text))
+}
+
+// apply updates the style with the parameters of an SGR sequence.
+func (r *ansiRenderer) apply(params string) {
+	codes := []int{}
+	for _, param := range strings.Split(params, ";") {
+		code, err := strconv.Atoi(param)
+		if err != nil {
+			code = 0
+		}
+		codes = append(codes, code)
+	}
+
+	for i := 0; i < len(codes); i++ {
+		code := codes[i]
+		switch {
+		case code == 0:
+			r.style = ansiStyle{}
+		case code == 1:
+			r.style.bold = true
+		case code == 2:
+			r.style.dim = true
+		case code == 3:
+			r.style.italic = true
+		case code == 4:
+			r.style.underline = true
+		case code == 22:
+			r.style.bold, r.style.dim = false, false
+		case code == 23:
+			r.style.italic = false
+		case code == 24:
+			r.style.underline = false
+		case code >= 30 && code <= 37:
+			r.style.fg = strconv.Itoa(code - 30)
+		case code >= 90 && code <= 97:
+			r.style.fg = strconv.Itoa(code - 90 + 8)
+		case code == 39:
+			r.style.fg = ""
+		case code >= 40 && code <= 47:
+			r.style.bg = strconv.Itoa(code - 40)
+		case code >= 100 && code <= 107:
+			r.style.bg = strconv.Itoa(code - 100 + 8)
+		case code == 49:
+			r.style.bg = ""
+		case code == 38 || code == 48:
+			color, n := extendedColor(codes[i+1:])
+			i += n
+			if code == 38 {
+				r.style.fg = color
+			} else {
+				r.style.bg = color
+			}
+		}
+	}
+}
+
+// extendedColor parses the color of a 38 or 48 code, either 5;n for the 256
+// colors palette or 2;r;g;b, returning it and the number of codes used.
+func extendedColor(codes []int) (string, int) {
+	if len(codes) >= 2 && codes[0] == 5 {
+		n := codes[1]
+		if n < 16 {
+			return strconv.Itoa(n), 2
+		}
+		return ansi256(n), 2
+	} else if len(codes) >= 4 && codes[0] == 2 {
+		return fmt.Sprintf("#%02x%02x%02x", codes[1]&0xff, codes[2]&0xff, codes[3]&0xff), 4
+	}
+	return "", len(codes)
+}
+
+// ansi256 returns the color of the 256 colors palette beyond the first 16:
+// a 6x6x6 cube followed by a ramp of grays.
+func ansi256(n int) string {
+	if n >= 232 {
+		gray := 8 + 10*(n-232)
+		return fmt.Sprintf("#%02x%02x%02x", gray, gray, gray)
+	}
+	n -= 16
+	level := func(v int) int {
+		if v == 0 {
+			return 0
+		}
+		return 55 + 40*v
+	}
+	return fmt.Sprintf("#%02x%02x%02x", level(n/36), level(n/6%6), level(n%6))
+}
+
+// ansiCSS styles the classes of the renderer with the usual xterm colors.
+const ansiCSS = `
+.ansi-bold { font-weight: bold; }
+.ansi-dim { opacity: 0.7; }
+.ansi-italic { font-style: italic; }
+.ansi-underline { text-decoration: underline; }
+.ansi-fg-0 { color: #000000; } .ansi-bg-0 { background-color: #000000; }
+.ansi-fg-1 { color: #cd3131; } .ansi-bg-1 { background-color: #cd3131; }
+.ansi-fg-2 { color: #0dbc79; } .ansi-bg-2 { background-color: #0dbc79; }
+.ansi-fg-3 { color: #949800; } .ansi-bg-3 { background-color: #e5e510; }
+.ansi-fg-4 { color: #2472c8; } .ansi-bg-4 { background-color: #2472c8; }
+.ansi-fg-5 { color: #bc3fbc; } .ansi-bg-5 { background-color: #bc3fbc; }
+.ansi-fg-6 { color: #11a8cd; } .ansi-bg-6 { background-color: #11a8cd; }
+.ansi-fg-7 { color: #666666; } .ansi-bg-7 { background-color: #e5e5e5; }
+.ansi-fg-8 { color: #666666; } .ansi-bg-8 { background-color: #666666; }
+.ansi-fg-9 { color: #f14c4c; } .ansi-bg-9 { background-color: #f14c4c; }
+.ansi-fg-10 { color: #23d18b; } .ansi-bg-10 { background-color: #23d18b; }
+.ansi-fg-11 { color: #b5ba00; } .ansi-bg-11 { background-color: #f5f543; }
+.ansi-fg-12 { color: #3b8eea; } .ansi-bg-12 { background-color: #3b8eea; }
+.ansi-fg-13 { color: #d670d6; } .ansi-bg-13 { background-color: #d670d6; }
+.ansi-fg-14 { color: #29b8db; } .ansi-bg-14 { background-color: #29b8db; }
+.ansi-fg-15 { color: #333333; } .ansi-bg-15 { background-color: #e5e5e5; }
+`
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"html/template"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripANSI(t *testing.T) {
+	assert.Equal(t, "ok  github.com/x 0.1s", StripANSI("\x1b[32mok\x1b[0m  github.com/x \x1b[1;2m0.1s\x1b[m"))
+	assert.Equal(t, "title", StripANSI("\x1b]0;jarvis\x07title\x1b[2K"))
+}
+
+func TestANSIRenderer(t *testing.T) {
+	r := &ansiRenderer{}
+	assert.Equal(t, template.HTML(`<span class="ansi-bold ansi-fg-1">FAIL</span> &lt;pkg&gt;`), r.Render("\x1b[1;31mFAIL\x1b[0m <pkg>"))
+
+	// The style carries over to the next line until reset
+	assert.Equal(t, template.HTML(`<span class="ansi-fg-10">one</span>`), r.Render("\x1b[92mone"))
+	assert.Equal(t, template.HTML(`<span class="ansi-fg-10">two</span>three`), r.Render("two\x1b[39mthree"))
+
+	assert.Equal(t, template.HTML(`<span style="color:#ff8000;background-color:#5f87af">x</span>`), r.Render("\x1b[38;2;255;128;0;48;5;67mx\x1b[0m"))
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const (
+	API_DEFAULT_LIMIT = 50
+	API_MAX_LIMIT     = 500
+)
+
+// apiHandler serves the JSON API of the jobs under {BasePath}/api/v1/:
+//
+//	GET jobs?repo=&branch=&state=&limit=&offset=
+//	GET jobs/{id}
+//	GET jobs/{id}/targets/{target}/log
+//	GET repos/{owner}/{repo}/branches/{branch}/latest?state=
+type apiHandler struct {
+	jobs    JobStore
+	outputs OutputHandler
+}
+
+// apiJob is a job along with the fields derived from it.
+type apiJob struct {
+	*Job
+	Branch string `json:"branch"`
+	URL    string `json:"url"`
+}
+
+type apiJobList struct {
+	Jobs   []apiJob `json:"jobs"`
+	Limit  int      `json:"limit"`
+	Offset int      `json:"offset"`
+	Next   string   `json:"next,omitempty"`
+}
+
+type apiTargetLog struct {
+	JobID   string      `json:"job_id"`
+	Target  string      `json:"target"`
+	Records []LogRecord `json:"records"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func NewAPIHandler(jobs JobStore, outputs OutputHandler) *apiHandler {
+	h := &apiHandler{}
+	h.jobs = jobs
+	h.outputs = outputs
+	return h
+}
+
+func (h *apiHandler) root() string {
+	return path.Join(BasePath, "/api/v1")
+}
+
+func (h *apiHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	glog.Infof("Handling API request: %s", req.URL.Path)
+	if req.Method != "GET" {
+		h.writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(req.URL.Path, h.root()), "/")
+	parts := strings.Split(rest, "/")
+	switch {
+	case rest == "jobs":
+		h.listJobs(w, req)
+	case len(parts) == 2 && parts[0] == "jobs":
+		h.getJob(w, parts[1])
+	case len(parts) == 5 && parts[0] == "jobs" && parts[2] == "targets" && parts[4] == "log":
+		h.getTargetLog(w, parts[1], parts[3])
+	case len(parts) >= 6 && parts[0] == "repos" && parts[3] == "branches" && parts[len(parts)-1] == "latest":
+		// Branch names can contain slashes
+		repo := parts[1] + "/" + parts[2]
+		branch := strings.Join(parts[4:len(parts)-1], "/")
+		h.getLatest(w, req, repo, branch)
+	default:
+		h.writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (h *apiHandler) listJobs(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	filter := JobFilter{
+		Repo:   query.Get("repo"),
+		Branch: query.Get("branch"),
+		State:  query.Get("state"),
+		Limit:  API_DEFAULT_LIMIT,
+	}
+
+	var err error
+	if value := query.Get("limit"); value != "" {
+		filter.Limit, err = strconv.Atoi(value)
+		if err != nil || filter.Limit < 1 || filter.Limit > API_MAX_LIMIT {
+			h.writeError(w, http.StatusBadRequest, fmt.Sprintf("Limit must be between 1 and %d", API_MAX_LIMIT))
+			return
+		}
+	}
+	if value := query.Get("offset"); value != "" {
+		filter.Offset, err = strconv.Atoi(value)
+		if err != nil || filter.Offset < 0 {
+			h.writeError(w, http.StatusBadRequest, "Offset must be a positive integer")
+			return
+		}
+	}
+
+	jobs, err := h.jobs.List(filter)
+	if err != nil {
+		glog.Errorf("Failed to list jobs: %v", err)
+		h.writeError(w, http.StatusInternalServerError, "Failed to list jobs")
+		return
+	}
+
+	list := apiJobList{Jobs: []apiJob{}, Limit: filter.Limit, Offset: filter.Offset}
+	for _, job := range jobs {
+		list.Jobs = append(list.Jobs, h.apiJob(job))
+	}
+	if len(jobs) == filter.Limit {
+		next := url.Values{}
+		for key, values := range query {
+			next[key] = values
+		}
+		next.Set("limit", strconv.Itoa(filter.Limit))
+		next.Set("offset", strconv.Itoa(filter.Offset+filter.Limit))
+		list.Next = h.root() + "/jobs?" + next.Encode()
+	}
+	h.write(w, http.StatusOK, list)
+}
+
+func (h *apiHandler) getJob(w http.ResponseWriter, jobid string) {
+	job, ok := h.job(w, jobid)
+	if ok {
+		h.write(w, http.StatusOK, h.apiJob(job))
+	}
+}
+
+func (h *apiHandler) getTargetLog(w http.ResponseWriter, jobid string, target string) {
+	if _, ok := h.job(w, jobid); !ok {
+		return
+	}
+	records, found := targetLog(h.outputs.GetOutput(jobid), target)
+	if !found {
+		h.writeError(w, http.StatusNotFound, fmt.Sprintf("No log for target %s", target))
+		return
+	}
+	h.write(w, http.StatusOK, apiTargetLog{jobid, target, records})
+}
+
+func (h *apiHandler) getLatest(w http.ResponseWriter, req *http.Request, repo string, branch string) {
+	job, err := LastJob(h.jobs, repo, branch, req.URL.Query().Get("state"))
+	if err != nil {
+		glog.Errorf("Failed to get latest job of %s@%s: %v", repo, branch, err)
+		h.writeError(w, http.StatusInternalServerError, "Failed to get latest job")
+		return
+	} else if job == nil {
+		h.writeError(w, http.StatusNotFound, "No job found")
+		return
+	}
+	h.write(w, http.StatusOK, h.apiJob(job))
+}
+
+// job returns the job, writing the error response if there is none.
+func (h *apiHandler) job(w http.ResponseWriter, jobid string) (*Job, bool) {
+	job, err := h.jobs.Get(jobid)
+	if err != nil {
+		glog.Errorf("Failed to get job %s: %v", jobid, err)
+		h.writeError(w, http.StatusInternalServerError, "Failed to get job")
+		return nil, false
+	} else if job == nil {
+		h.writeError(w, http.StatusNotFound, "Job not found")
+		return nil, false
+	}
+	return job, true
+}
+
+func (h *apiHandler) apiJob(job *Job) apiJob {
+	return apiJob{job, job.Branch(), h.root() + "/jobs/" + job.ID}
+}
+
+func (h *apiHandler) writeError(w http.ResponseWriter, code int, message string) {
+	h.write(w, code, apiError{message})
+}
+
+func (h *apiHandler) write(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		glog.Errorf("Failed to write API response: %v", err)
+	}
+}
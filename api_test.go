@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPI(t *testing.T) {
+	jobs := NewMemoryJobStore(10)
+	outputs := NewOutputHandler(10)
+	for _, ref := range []string{"refs/heads/master", "refs/heads/feature/x", "refs/heads/master"} {
+		job := NewJob(TRIGGER_PUSH)
+		job.Repo, job.Ref = "owner/repo", ref
+		job.Finish(JOB_SUCCESS)
+		jobs.Save(job)
+	}
+	latest, _ := LastJob(jobs, "owner/repo", "master", "")
+	outputs.AddOutput(latest.ID, "", STREAM_JARVIS, "JOB: "+latest.ID)
+	outputs.AddOutput(latest.ID, "jarvis-ci-test", STREAM_STDOUT, "ok\ndone")
+
+	api := NewAPIHandler(jobs, outputs)
+	get := func(uri string, value interface{}) int {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", BasePath+"/api/v1"+uri, nil))
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), value), uri)
+		return w.Code
+	}
+
+	list := map[string]interface{}{}
+	assert.Equal(t, 200, get("/jobs?branch=master&limit=1", &list))
+	assert.Equal(t, 1, len(list["jobs"].([]interface{})))
+	assert.Equal(t, latest.ID, list["jobs"].([]interface{})[0].(map[string]interface{})["id"])
+	assert.Contains(t, list["next"], "offset=1")
+
+	job := map[string]interface{}{}
+	assert.Equal(t, 200, get("/repos/owner/repo/branches/feature/x/latest", &job))
+	assert.Equal(t, "feature/x", job["branch"])
+	assert.Equal(t, "success", job["state"])
+
+	log := map[string]interface{}{}
+	assert.Equal(t, 200, get("/jobs/"+latest.ID+"/targets/jarvis-ci-test/log", &log))
+	records := log["records"].([]interface{})
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, "done", records[1].(map[string]interface{})["text"])
+	assert.Equal(t, 3.0, records[1].(map[string]interface{})["line"])
+
+	assert.Equal(t, 404, get("/jobs/unknown", &job))
+	assert.Equal(t, "Job not found", job["error"])
+	assert.Equal(t, 400, get("/jobs?limit=0", &job))
+}
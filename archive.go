@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	ARCHIVE_SERVE_REDIRECT = "redirect"
+	ARCHIVE_SERVE_PROXY    = "proxy"
+	ARCHIVE_LOG_FILE       = "output.log"
+	ARCHIVE_RECORDS_FILE   = "output.jsonl"
+	ARCHIVE_URL_EXPIRY     = 15 * time.Minute
+)
+
+var (
+	ArchiveEndpoint      string
+	ArchiveBucket        string
+	ArchiveRegion        string
+	ArchivePrefix        string
+	ArchiveAccessKeyPath string
+	ArchiveSecretKeyPath string
+	ArchiveServe         string
+)
+
+func init() {
+	flag.StringVar(&ArchiveEndpoint, "archive-endpoint", "", "The S3-compatible endpoint where logs and artifacts are archived, empty to disable archiving")
+	flag.StringVar(&ArchiveBucket, "archive-bucket", "jarvis-ci", "The bucket of the archive")
+	flag.StringVar(&ArchiveRegion, "archive-region", "us-east-1", "The region of the archive")
+	flag.StringVar(&ArchivePrefix, "archive-prefix", "jobs", "The prefix of the keys of the archived jobs")
+	flag.StringVar(&ArchiveAccessKeyPath, "archive-access-key", "/jarvis-ci/archive-access-key", "The access key id of the archive")
+	flag.StringVar(&ArchiveSecretKeyPath, "archive-secret-key", "/jarvis-ci/archive-secret-key", "The secret access key of the archive")
+	flag.StringVar(&ArchiveServe, "archive-serve", ARCHIVE_SERVE_REDIRECT, "How archived logs are served: redirect or proxy")
+}
+
+// archiver uploads the logs and artifacts of finished jobs to object
+// storage, under prefix/jobid/.
+type archiver struct {
+	client *s3Client
+	prefix string
+	serve  string
+}
+
+// DefaultArchiver returns the archiver configured by the flags, nil if
+// archiving is disabled.
+func DefaultArchiver() (*archiver, error) {
+	if ArchiveEndpoint == "" {
+		return nil, nil
+	}
+	if ArchiveServe != ARCHIVE_SERVE_REDIRECT && ArchiveServe != ARCHIVE_SERVE_PROXY {
+		return nil, fmt.Errorf("Unknown archive serving mode: %s", ArchiveServe)
+	}
+
+	accessKey, err := ioutil.ReadFile(ArchiveAccessKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read archive access key: %v", err)
+	}
+	secretKey, err := ioutil.ReadFile(ArchiveSecretKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read archive secret key: %v", err)
+	}
+
+	client, err := NewS3Client(ArchiveEndpoint, ArchiveBucket, ArchiveRegion,
+		strings.TrimSpace(string(accessKey)), strings.TrimSpace(string(secretKey)))
+	if err != nil {
+		return nil, err
+	}
+	return NewArchiver(client, ArchivePrefix, ArchiveServe), nil
+}
+
+func NewArchiver(client *s3Client, prefix string, serve string) *archiver {
+	a := &archiver{}
+	a.client = client
+	a.prefix = strings.Trim(prefix, "/")
+	a.serve = serve
+	return a
+}
+
+// Values returns the credentials of the archive, to keep them out of the
+// logs.
+func (a *archiver) Values() []string {
+	if a == nil {
+		return []string{}
+	}
+	return []string{a.client.secretKey}
+}
+
+func (a *archiver) key(jobid string, name string) string {
+	return path.Join(a.prefix, jobid, name)
+}
+
+// Archive uploads the log of the job, as text and as records, and its
+// artifacts, and records the location of the log on the job.
+func (a *archiver) Archive(job *Job, records []LogRecord, artifacts *artifactStore) error {
+	content := &bytes.Buffer{}
+	err := writeJSONL(content, records)
+	if err != nil {
+		return err
+	}
+	err = a.client.PutObject(a.key(job.ID, ARCHIVE_RECORDS_FILE), content, int64(content.Len()), "application/x-ndjson")
+	if err != nil {
+		return err
+	}
+
+	log := &bytes.Buffer{}
+	err = writeText(log, records)
+	if err != nil {
+		return err
+	}
+	key := a.key(job.ID, ARCHIVE_LOG_FILE)
+	err = a.client.PutObject(key, log, int64(log.Len()), "text/plain; charset=utf-8")
+	if err != nil {
+		return err
+	}
+	job.SetLogLocation(fmt.Sprintf("s3://%s/%s", a.client.bucket, key))
+
+	list, err := artifacts.List(job.ID)
+	if err != nil {
+		return err
+	}
+	jobdir, err := artifacts.jobDir(job.ID)
+	if err != nil {
+		return err
+	}
+	for _, artifact := range list {
+		err = a.putFile(a.key(job.ID, path.Join("artifacts", artifact.Path)), filepath.Join(jobdir, filepath.FromSlash(artifact.Path)))
+		if err != nil {
+			return fmt.Errorf("Failed to archive artifact %s: %v", artifact.Path, err)
+		}
+	}
+	return nil
+}
+
+func (a *archiver) putFile(key string, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(filename))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return a.client.PutObject(key, f, fi.Size(), contentType)
+}
+
+// ServeLog serves the archived log of the job. The text log is served by
+// redirecting to a presigned URL or by proxying its content, the other
+// formats and options from the archived records.
+func (a *archiver) ServeLog(w http.ResponseWriter, req *http.Request, jobid string) {
+	if !validJobID.MatchString(jobid) {
+		http.Error(w, "Log is not in the archive", http.StatusNotFound)
+		return
+	}
+
+	query := req.URL.Query()
+	if (query.Get("format") != "" && query.Get("format") != LOG_FORMAT_TEXT) || query.Get("ansi") != "" || query.Get("download") != "" {
+		records, err := a.records(jobid)
+		if err != nil {
+			glog.Errorf("Failed to get archived log of %s: %v", jobid, err)
+			http.Error(w, "Failed to get archived log", http.StatusBadGateway)
+			return
+		}
+		serveOutput(w, req, jobid, records)
+		return
+	}
+
+	key := a.key(jobid, ARCHIVE_LOG_FILE)
+	if a.serve == ARCHIVE_SERVE_REDIRECT {
+		http.Redirect(w, req, a.client.PresignGet(key, ARCHIVE_URL_EXPIRY), http.StatusFound)
+		return
+	}
+
+	resp, err := a.client.GetObject(key)
+	if err != nil {
+		glog.Errorf("Failed to get archived log %s: %v", key, err)
+		http.Error(w, "Failed to get archived log", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.Copy(w, resp.Body)
+}
+
+// records downloads the archived records of the job.
+func (a *archiver) records(jobid string) ([]LogRecord, error) {
+	resp, err := a.client.GetObject(a.key(jobid, ARCHIVE_RECORDS_FILE))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	records := []LogRecord{}
+	decoder := json.NewDecoder(resp.Body)
+	for decoder.More() {
+		record := LogRecord{}
+		if err = decoder.Decode(&record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 keeps the objects uploaded to it in memory.
+type fakeS3 struct {
+	objects map[string]string
+	lock    sync.Mutex
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch req.Method {
+	case "PUT":
+		content, _ := ioutil.ReadAll(req.Body)
+		s.objects[req.URL.Path] = string(content)
+	case "GET":
+		content, ok := s.objects[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte(content))
+	}
+}
+
+func TestArchiveServesLogs(t *testing.T) {
+	s3 := &fakeS3{objects: map[string]string{}}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+	client, err := NewS3Client(server.URL, "bucket", "us-east-1", "access", "secret")
+	assert.Nil(t, err)
+	archiver := NewArchiver(client, "/jobs/", ARCHIVE_SERVE_PROXY)
+
+	dir, err := ioutil.TempDir("", "artifacts")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	job := NewJob(TRIGGER_PUSH)
+	records := newRecords(job.ID, "test", STREAM_STDOUT, "\x1b[31mok\x1b[0m", 0)
+	assert.Nil(t, archiver.Archive(job, records, NewArtifactStore(dir, 0)))
+	assert.Equal(t, "s3://bucket/jobs/"+job.ID+"/output.log", job.LogLocation)
+
+	get := func(url string) (int, string) {
+		w := httptest.NewRecorder()
+		archiver.ServeLog(w, httptest.NewRequest("GET", url, nil), job.ID)
+		return w.Code, w.Body.String()
+	}
+	code, body := get("/outputs/" + job.ID)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "TARGET: test")
+	_, body = get("/outputs/" + job.ID + "?format=jsonl&ansi=strip")
+	assert.Contains(t, body, `"target":"test"`)
+	assert.Contains(t, body, `"text":"ok"`)
+	_, body = get("/outputs/" + job.ID + "?format=html")
+	assert.Contains(t, body, "<html")
+
+	archiver.serve = ARCHIVE_SERVE_REDIRECT
+	w := httptest.NewRecorder()
+	archiver.ServeLog(w, httptest.NewRequest("GET", "/outputs/"+job.ID, nil), job.ID)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Contains(t, w.Header().Get("Location"), "/bucket/jobs/"+job.ID+"/output.log?")
+	w = httptest.NewRecorder()
+	archiver.ServeLog(w, httptest.NewRequest("GET", "/outputs/..", nil), "..")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
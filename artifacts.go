@@ -0,0 +1,232 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+var (
+	ArtifactsDir     string
+	ArtifactsMaxSize int64
+)
+
+func init() {
+	flag.StringVar(&ArtifactsDir, "artifacts-dir", "/jarvis-ci/artifacts", "The directory where the artifacts of the jobs are stored")
+	flag.Int64Var(&ArtifactsMaxSize, "artifacts-max-size", 500, "The maximum size in MB of the artifacts of a job")
+}
+
+type Artifact struct {
+	Path string
+	Size int64
+}
+
+// artifactStore keeps the artifacts of every job under dir/jobid.
+type artifactStore struct {
+	dir     string
+	maxsize int64
+}
+
+func DefaultArtifactStore() *artifactStore {
+	return NewArtifactStore(ArtifactsDir, ArtifactsMaxSize*1024*1024)
+}
+
+func NewArtifactStore(dir string, maxsize int64) *artifactStore {
+	store := &artifactStore{}
+	store.dir = dir
+	store.maxsize = maxsize
+	return store
+}
+
+func (s *artifactStore) jobDir(jobid string) (string, error) {
+	if jobid == "" || strings.ContainsAny(jobid, "/\\") || jobid == "." || jobid == ".." {
+		return "", fmt.Errorf("Invalid job id: %s", jobid)
+	}
+	return filepath.Join(s.dir, jobid), nil
+}
+
+// Collect copies the regular files of workdir matching the patterns into the
+// storage of the job. Patterns matching a directory collect all of its
+// files. Files that would take the job over its size limit are skipped, and
+// reported in the error once the others are collected.
+func (s *artifactStore) Collect(jobid string, workdir string, patterns []string) ([]Artifact, error) {
+	jobdir, err := s.jobDir(jobid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the matching files
+	files := []string{}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(workdir, filepath.Clean("/"+pattern)))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid artifact pattern %s: %v", pattern, err)
+		}
+		for _, match := range matches {
+			filepath.Walk(match, func(filename string, fi os.FileInfo, err error) error {
+				if err == nil && fi.Mode().IsRegular() {
+					files = append(files, filename)
+				}
+				return nil
+			})
+		}
+	}
+
+	size, _ := dirSize(jobdir)
+	artifacts := []Artifact{}
+	skipped := []string{}
+	seen := map[string]bool{}
+	for _, filename := range files {
+		rel, err := filepath.Rel(workdir, filename)
+		if err != nil || seen[rel] {
+			continue
+		}
+		seen[rel] = true
+
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return artifacts, err
+		} else if size+fi.Size() > s.maxsize {
+			skipped = append(skipped, rel)
+			continue
+		}
+
+		err = copyFile(filename, filepath.Join(jobdir, rel))
+		if err != nil {
+			return artifacts, fmt.Errorf("Failed to store artifact %s: %v", rel, err)
+		}
+		size += fi.Size()
+		artifacts = append(artifacts, Artifact{filepath.ToSlash(rel), fi.Size()})
+	}
+	if len(skipped) > 0 {
+		return artifacts, fmt.Errorf("Artifacts are over the limit of %d bytes, skipped %s", s.maxsize, strings.Join(skipped, ", "))
+	}
+	return artifacts, nil
+}
+
+// List returns the artifacts of the job.
+func (s *artifactStore) List(jobid string) ([]Artifact, error) {
+	jobdir, err := s.jobDir(jobid)
+	if err != nil {
+		return nil, err
+	}
+
+	artifacts := []Artifact{}
+	err = filepath.Walk(jobdir, func(filename string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(jobdir, filename)
+		if err != nil {
+			return err
+		}
+		artifacts = append(artifacts, Artifact{filepath.ToSlash(rel), fi.Size()})
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return artifacts, nil
+	}
+	sort.Sort(artifactsByPath(artifacts))
+	return artifacts, err
+}
+
+// ServeHTTP serves {BasePath}/jobs/{id}/artifacts/{path}, listing the
+// artifacts of the job when the path is empty.
+func (s *artifactStore) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	glog.Infof("Handling artifact request: %s", req.URL.Path)
+
+	// Artifacts are written by the builds, keep their HTML and scripts from
+	// running on the origin of jarvis
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	rest := strings.TrimPrefix(req.URL.Path, path.Join(BasePath, "/jobs")+"/")
+	parts := strings.SplitN(rest, "/", 3)
+	if len(parts) < 2 || parts[1] != "artifacts" {
+		http.NotFound(w, req)
+		return
+	}
+
+	jobid := parts[0]
+	jobdir, err := s.jobDir(jobid)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	name := ""
+	if len(parts) == 3 {
+		name = parts[2]
+	}
+	if name == "" {
+		artifacts, err := s.List(jobid)
+		if err != nil {
+			http.Error(w, "Failed to list artifacts", http.StatusInternalServerError)
+			return
+		}
+		for _, artifact := range artifacts {
+			fmt.Fprintf(w, "%s\t%d\n", artifact.Path, artifact.Size)
+		}
+		return
+	}
+
+	filename := filepath.Join(jobdir, filepath.FromSlash(path.Clean("/"+name)))
+	fi, err := os.Stat(filename)
+	if err != nil || !fi.Mode().IsRegular() {
+		http.NotFound(w, req)
+		return
+	}
+	http.ServeFile(w, req, filename)
+}
+
+type artifactsByPath []Artifact
+
+func (a artifactsByPath) Len() int           { return len(a) }
+func (a artifactsByPath) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a artifactsByPath) Less(i, j int) bool { return a[i].Path < a[j].Path }
+
+func copyFile(src, dst string) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func dirSize(dir string) (int64, error) {
+	size := int64(0)
+	err := filepath.Walk(dir, func(filename string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
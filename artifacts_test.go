@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArtifactStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	workdir := filepath.Join(dir, "clone")
+	for name, size := range map[string]int{"bin/app": 6, "bin/big": 20, "coverage.html": 4, "logs/a/b.log": 3, "secret": 1} {
+		filename := filepath.Join(workdir, filepath.FromSlash(name))
+		assert.Nil(t, os.MkdirAll(filepath.Dir(filename), 0755))
+		assert.Nil(t, ioutil.WriteFile(filename, make([]byte, size), 0644))
+	}
+	assert.Nil(t, os.Symlink(filepath.Join(workdir, "secret"), filepath.Join(workdir, "bin", "link")))
+
+	// The files over the limit are skipped, the others still collected
+	store := NewArtifactStore(filepath.Join(dir, "store"), 16)
+	artifacts, err := store.Collect("job-1", workdir, []string{"bin/*", "../coverage.html", "logs", "missing/*"})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "skipped bin/big")
+	assert.Equal(t, []Artifact{{"bin/app", 6}, {"coverage.html", 4}, {"logs/a/b.log", 3}}, artifacts)
+
+	listed, err := store.List("job-1")
+	assert.Nil(t, err)
+	assert.Equal(t, artifacts, listed)
+	_, err = store.Collect("../job", workdir, []string{"bin/app"})
+	assert.NotNil(t, err)
+
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		store.ServeHTTP(w, httptest.NewRequest("GET", BasePath+"/jobs/"+path, nil))
+		assert.Equal(t, "sandbox", w.Header().Get("Content-Security-Policy"))
+		assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+		return w.Code, w.Body.String()
+	}
+	code, body := get("job-1/artifacts/")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "bin/app\t6\ncoverage.html\t4\nlogs/a/b.log\t3\n", body)
+	code, _ = get("job-1/artifacts/logs/a/b.log")
+	assert.Equal(t, 200, code)
+	code, _ = get("job-1/artifacts/coverage.html")
+	assert.Equal(t, 200, code)
+
+	// Nothing outside of the artifacts of the job is served
+	for _, path := range []string{"job-1/artifacts/logs", "job-1/artifacts/../../clone/secret", "job-1/artifacts/..%2F..%2Fclone%2Fsecret", "../artifacts/store", "job-2/artifacts/bin/app", "job-1/other"} {
+		code, _ = get(path)
+		assert.Equal(t, 404, code, path)
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	CachesDir     string
+	CachesMaxSize int64
+)
+
+func init() {
+	flag.StringVar(&CachesDir, "caches-dir", "/jarvis-ci/caches", "The directory where the dependency caches of the targets are stored")
+	flag.Int64Var(&CachesMaxSize, "caches-max-size", 5*1024, "The disk budget in MB of the dependency caches")
+}
+
+// CacheConfig declares directories restored before a target and saved after
+// it. The key of the cache is Key followed by the hash of Paths and of the
+// content of the files matching Files, such as go.sum or package-lock.json.
+// When no cache has that exact key, the most recently saved cache whose key
+// starts with one of RestoreKeys, or that of Key, is restored instead.
+type CacheConfig struct {
+	Key         string   `json:"key"`
+	Paths       []string `json:"paths"`
+	Files       []string `json:"files"`
+	RestoreKeys []string `json:"restore_keys"`
+}
+
+// cacheStore keeps the caches of every repository and ref as compressed
+// tarballs under dir/owner/repo/ref/key.tar.gz, evicting the least recently
+// used ones to stay within its budget. A ref only restores its own caches or
+// those of the default ref, so that no branch can poison the caches of
+// another. The modification time of a cache is when it was saved, that of
+// its .used file when it was last saved or restored.
+type cacheStore struct {
+	dir     string
+	maxsize int64
+	lock    *sync.Mutex
+}
+
+func DefaultCacheStore() *cacheStore {
+	return NewCacheStore(CachesDir, CachesMaxSize*1024*1024)
+}
+
+func NewCacheStore(dir string, maxsize int64) *cacheStore {
+	store := &cacheStore{}
+	store.dir = dir
+	store.maxsize = maxsize
+	store.lock = &sync.Mutex{}
+	return store
+}
+
+// Key computes the key of the cache from the files of the workdir.
+func (s *cacheStore) Key(workdir string, config CacheConfig) (string, error) {
+	if config.Key == "" || strings.ContainsAny(config.Key, "/\\") || len(config.Paths) == 0 {
+		return "", fmt.Errorf("Caches need a key without slashes and paths")
+	}
+
+	hash := sha256.New()
+	for _, p := range config.Paths {
+		fmt.Fprintf(hash, "%s\x00", p)
+	}
+	for _, pattern := range config.Files {
+		matches, err := filepath.Glob(filepath.Join(workdir, filepath.Clean("/"+pattern)))
+		if err != nil {
+			return "", fmt.Errorf("Invalid cache file pattern %s: %v", pattern, err)
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			f, err := os.Open(match)
+			if err != nil {
+				return "", err
+			}
+			_, err = io.Copy(hash, f)
+			f.Close()
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	return config.Key + "-" + hex.EncodeToString(hash.Sum(nil))[:16], nil
+}
+
+// Restore extracts the cache of the ref with the key, or the newest one
+// matching the restore keys, falling back to the caches of the default ref,
+// and returns the key of the cache restored. An empty key means that no
+// cache matched. The paths under ~/ are restored in home.
+func (s *cacheStore) Restore(repo string, ref string, defaultRef string, workdir string, home string, key string, config CacheConfig) (string, error) {
+	refs := []string{ref}
+	if defaultRef != "" && defaultRef != ref {
+		refs = append(refs, defaultRef)
+	}
+
+	filename := ""
+	for _, ref := range refs {
+		dir, err := s.refDir(repo, ref)
+		if err != nil {
+			return "", err
+		}
+		filename = findCache(dir, key, config)
+		if filename != "" {
+			break
+		}
+	}
+	if filename == "" {
+		return "", nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	touchCache(filename)
+
+	err = extractCache(f, cachePaths(workdir, home, config.Paths))
+	if err != nil {
+		return "", fmt.Errorf("Failed to restore cache %s: %v", filepath.Base(filename), err)
+	}
+	return strings.TrimSuffix(filepath.Base(filename), ".tar.gz"), nil
+}
+
+// Save archives the paths of the cache under the key, among the caches of
+// the ref.
+func (s *cacheStore) Save(repo string, ref string, workdir string, home string, key string, config CacheConfig) error {
+	dir, err := s.refDir(repo, ref)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file so that a concurrent restore never sees a
+	// partial cache
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = archiveCache(tmp, cachePaths(workdir, home, config.Paths))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to archive cache %s: %v", key, err)
+	}
+	filename := filepath.Join(dir, key+".tar.gz")
+	err = os.Rename(tmp.Name(), filename)
+	if err != nil {
+		return err
+	}
+	touchCache(filename)
+
+	s.evict()
+	return nil
+}
+
+func (s *cacheStore) refDir(repo string, ref string) (string, error) {
+	parts := strings.Split(repo, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || parts[0] == ".." || parts[1] == ".." {
+		return "", fmt.Errorf("Invalid repository name: %s", repo)
+	} else if !strings.HasPrefix(ref, "refs/") {
+		return "", fmt.Errorf("Invalid ref: %s", ref)
+	}
+	return filepath.Join(s.dir, parts[0], parts[1], url.QueryEscape(ref)), nil
+}
+
+// evict removes the least recently used caches until the store is within
+// its budget.
+func (s *cacheStore) evict() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	files, _ := filepath.Glob(filepath.Join(s.dir, "*", "*", "*", "*.tar.gz"))
+	caches := []diskEntry{}
+	total := int64(0)
+	for _, filename := range files {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			continue
+		}
+		lastuse := fi.ModTime()
+		if used, err := os.Stat(filename + ".used"); err == nil {
+			lastuse = used.ModTime()
+		}
+		total += fi.Size()
+		caches = append(caches, diskEntry{filename, fi.Size(), lastuse})
+	}
+	sort.Sort(entriesByLastUse(caches))
+
+	for _, cache := range caches {
+		if total <= s.maxsize {
+			return
+		}
+		glog.Infof("Evicting cache %s (%d bytes)", cache.path, cache.size)
+		if err := os.Remove(cache.path); err == nil {
+			os.Remove(cache.path + ".used")
+			total -= cache.size
+		}
+	}
+}
+
+// touchCache records that the cache was just used.
+func touchCache(filename string) {
+	f, err := os.OpenFile(filename+".used", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		glog.Warningf("Failed to record the use of cache %s: %v", filename, err)
+		return
+	}
+	f.Close()
+	now := time.Now()
+	os.Chtimes(filename+".used", now, now)
+}
+
+// findCache returns the cache of the directory with the key, or else the
+// newest one matching the restore keys or the key of the configuration.
+func findCache(dir string, key string, config CacheConfig) string {
+	filename := filepath.Join(dir, key+".tar.gz")
+	if _, err := os.Stat(filename); err == nil {
+		return filename
+	}
+	for _, prefix := range config.RestoreKeys {
+		filename = newestCache(dir, func(name string) bool { return strings.HasPrefix(name, prefix) })
+		if filename != "" {
+			return filename
+		}
+	}
+	return newestCache(dir, func(name string) bool { return isCacheOf(name, config.Key) })
+}
+
+// newestCache returns the most recently saved cache of the directory whose
+// key matches.
+func newestCache(dir string, match func(key string) bool) string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.tar.gz"))
+	newest, newestTime := "", time.Time{}
+	for _, filename := range files {
+		if !match(strings.TrimSuffix(filepath.Base(filename), ".tar.gz")) {
+			continue
+		}
+		fi, err := os.Stat(filename)
+		if err == nil && fi.ModTime().After(newestTime) {
+			newest, newestTime = filename, fi.ModTime()
+		}
+	}
+	return newest
+}
+
+// isCacheOf returns whether the key is one computed by Key for the key of a
+// cache configuration, rather than the key of another configuration that
+// merely starts with it.
+func isCacheOf(key string, configKey string) bool {
+	hash := strings.TrimPrefix(key, configKey+"-")
+	if hash == key || len(hash) != 16 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// cachePaths resolves the paths of a cache, relative to the workdir or to
+// the home directory of the job when starting with ~/.
+func cachePaths(workdir string, home string, paths []string) []string {
+	resolved := []string{}
+	for _, p := range paths {
+		if strings.HasPrefix(p, "~/") {
+			resolved = append(resolved, filepath.Join(home, filepath.Clean("/"+p[2:])))
+		} else {
+			resolved = append(resolved, filepath.Join(workdir, filepath.Clean("/"+p)))
+		}
+	}
+	return resolved
+}
+
+// archiveCache writes the paths to a tarball, the files of the i-th path
+// being stored under the directory i.
+func archiveCache(w io.Writer, paths []string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for i, root := range paths {
+		err := filepath.Walk(root, func(filename string, fi os.FileInfo, err error) error {
+			if os.IsNotExist(err) && filename == root {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(root, filename)
+			if err != nil {
+				return err
+			}
+			link := ""
+			if fi.Mode()&os.ModeSymlink != 0 {
+				if link, err = os.Readlink(filename); err != nil {
+					return err
+				}
+			} else if !fi.Mode().IsRegular() && !fi.IsDir() {
+				return nil
+			}
+
+			header, err := tar.FileInfoHeader(fi, link)
+			if err != nil {
+				return err
+			}
+			header.Name = filepath.ToSlash(filepath.Join(fmt.Sprintf("%d", i), rel))
+			if err = tw.WriteHeader(header); err != nil {
+				return err
+			} else if !fi.Mode().IsRegular() {
+				return nil
+			}
+
+			f, err := os.Open(filename)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// extractCache extracts a tarball written by archiveCache over the paths.
+// Nothing is written outside of the paths, whether through .. or through
+// the symlinks of the tarball, which may only point within their path.
+func extractCache(r io.Reader, paths []string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		parts := strings.SplitN(filepath.ToSlash(filepath.Clean(header.Name)), "/", 2)
+		index := 0
+		if _, err := fmt.Sscanf(parts[0], "%d", &index); err != nil || index < 0 || index >= len(paths) {
+			continue
+		}
+		filename := paths[index]
+		if len(parts) == 2 {
+			if strings.HasPrefix(parts[1], "../") || parts[1] == ".." {
+				continue
+			}
+			filename = filepath.Join(paths[index], filepath.FromSlash(parts[1]))
+		}
+
+		err = checkWithin(paths[index], filename)
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(filename, os.FileMode(header.Mode)|0700)
+		case tar.TypeSymlink:
+			target := filepath.Join(filepath.Dir(filename), filepath.FromSlash(header.Linkname))
+			if filepath.IsAbs(header.Linkname) || !isWithin(paths[index], target) {
+				return fmt.Errorf("Symlink %s points outside of the cache: %s", header.Name, header.Linkname)
+			}
+			os.Remove(filename)
+			err = os.Symlink(header.Linkname, filename)
+		case tar.TypeReg:
+			err = extractFile(tr, filename, os.FileMode(header.Mode))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// checkWithin makes sure that the parent directory of the file under the
+// root, once its symlinks are resolved, is within the root.
+func checkWithin(root string, filename string) error {
+	if filename == root {
+		return nil
+	}
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return err
+	}
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	// Resolve the deepest directory that exists, the others are created in it
+	dir := filepath.Dir(filename)
+	for {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			if !isWithin(resolvedRoot, resolved) {
+				return fmt.Errorf("Cache entry %s is outside of %s", filename, root)
+			}
+			return nil
+		} else if !os.IsNotExist(err) || dir == filepath.Dir(dir) {
+			return err
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// isWithin returns whether the path is the root or under it, lexically.
+func isWithin(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func extractFile(r io.Reader, filename string, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+	os.Remove(filename)
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
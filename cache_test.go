@@ -0,0 +1,206 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheSaveRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	workdir, home := filepath.Join(dir, "work"), filepath.Join(dir, "home")
+	assert.Nil(t, os.MkdirAll(filepath.Join(workdir, "deps", "pkg"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(workdir, "go.sum"), []byte("v1"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(workdir, "deps", "pkg", "lib"), []byte("lib"), 0644))
+
+	store := NewCacheStore(filepath.Join(dir, "caches"), 1<<30)
+	config := CacheConfig{Key: "deps", Paths: []string{"deps"}, Files: []string{"go.sum"}}
+	key, err := store.Key(workdir, config)
+	assert.Nil(t, err)
+
+	restored, err := store.Restore("owner/repo", "refs/heads/master", "refs/heads/master", workdir, home, key, config)
+	assert.Nil(t, err)
+	assert.Equal(t, "", restored)
+	assert.Nil(t, store.Save("owner/repo", "refs/heads/master", workdir, home, key, config))
+
+	// A new lockfile falls back to the previous cache
+	assert.Nil(t, os.RemoveAll(filepath.Join(workdir, "deps")))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(workdir, "go.sum"), []byte("v2"), 0644))
+	newkey, err := store.Key(workdir, config)
+	assert.Nil(t, err)
+	assert.NotEqual(t, key, newkey)
+
+	restored, err = store.Restore("owner/repo", "refs/heads/master", "refs/heads/master", workdir, home, newkey, config)
+	assert.Nil(t, err)
+	assert.Equal(t, key, restored)
+	content, err := ioutil.ReadFile(filepath.Join(workdir, "deps", "pkg", "lib"))
+	assert.Nil(t, err)
+	assert.Equal(t, "lib", string(content))
+}
+
+func TestCacheKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	workdir, home := filepath.Join(dir, "work"), filepath.Join(dir, "home")
+	assert.Nil(t, os.MkdirAll(filepath.Join(home, "go", "mod"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(home, "go", "mod", "lib"), []byte("lib"), 0644))
+
+	// The caches under ~/ are those of the home of the job
+	store := NewCacheStore(filepath.Join(dir, "caches"), 1<<30)
+	test := CacheConfig{Key: "deps-test", Paths: []string{"~/go/mod"}}
+	key, err := store.Key(workdir, test)
+	assert.Nil(t, err)
+	assert.Nil(t, store.Save("owner/repo", "refs/heads/master", workdir, home, key, test))
+
+	// Another cache whose key starts with the same text is not restored
+	deps := CacheConfig{Key: "deps", Paths: []string{"~/go/mod"}, Files: []string{"go.sum"}}
+	key, err = store.Key(workdir, deps)
+	assert.Nil(t, err)
+	restored, err := store.Restore("owner/repo", "refs/heads/master", "refs/heads/master", workdir, filepath.Join(dir, "other"), key, deps)
+	assert.Nil(t, err)
+	assert.Equal(t, "", restored)
+
+	deps.RestoreKeys = []string{"deps-"}
+	restored, err = store.Restore("owner/repo", "refs/heads/master", "refs/heads/master", workdir, filepath.Join(dir, "other"), key, deps)
+	assert.Nil(t, err)
+	assert.True(t, isCacheOf(restored, "deps-test"))
+	content, err := ioutil.ReadFile(filepath.Join(dir, "other", "go", "mod", "lib"))
+	assert.Nil(t, err)
+	assert.Equal(t, "lib", string(content))
+}
+
+func TestCacheBranches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	workdir, home := filepath.Join(dir, "work"), filepath.Join(dir, "home")
+	store := NewCacheStore(filepath.Join(dir, "caches"), 1<<30)
+	config := CacheConfig{Key: "deps", Paths: []string{"deps"}}
+	save := func(ref string, key string, content string) {
+		assert.Nil(t, os.MkdirAll(filepath.Join(workdir, "deps"), 0755))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(workdir, "deps", "lib"), []byte(content), 0644))
+		assert.Nil(t, store.Save("owner/repo", ref, workdir, home, key, config))
+	}
+	restore := func(ref string, key string) (string, string) {
+		assert.Nil(t, os.RemoveAll(filepath.Join(workdir, "deps")))
+		restored, err := store.Restore("owner/repo", ref, "refs/heads/master", workdir, home, key, config)
+		assert.Nil(t, err)
+		content, _ := ioutil.ReadFile(filepath.Join(workdir, "deps", "lib"))
+		return restored, string(content)
+	}
+
+	// A branch falls back to the caches of the default branch
+	save("refs/heads/master", "deps-0000000000000001", "master")
+	restored, content := restore("refs/heads/feature", "deps-0000000000000002")
+	assert.Equal(t, "deps-0000000000000001", restored)
+	assert.Equal(t, "master", content)
+
+	// The caches of a branch are never restored by another
+	save("refs/heads/feature", "deps-0000000000000002", "feature")
+	restored, content = restore("refs/heads/feature", "deps-0000000000000002")
+	assert.Equal(t, "deps-0000000000000002", restored)
+	assert.Equal(t, "feature", content)
+	restored, content = restore("refs/heads/master", "deps-0000000000000002")
+	assert.Equal(t, "deps-0000000000000001", restored)
+	assert.Equal(t, "master", content)
+	restored, _ = restore("refs/heads/other", "deps-0000000000000002")
+	assert.Equal(t, "deps-0000000000000001", restored)
+
+	// Restoring a cache makes it recently used but not recently saved
+	past := time.Now().Add(-time.Hour)
+	master := filepath.Join(dir, "caches", "owner", "repo", "refs%2Fheads%2Fmaster")
+	assert.Nil(t, os.Chtimes(filepath.Join(master, "deps-0000000000000001.tar.gz"), past, past))
+	save("refs/heads/master", "deps-0000000000000003", "newer")
+	assert.Nil(t, os.Chtimes(filepath.Join(master, "deps-0000000000000003.tar.gz.used"), past, past))
+	restored, _ = restore("refs/heads/master", "deps-0000000000000001")
+	assert.Equal(t, "deps-0000000000000001", restored)
+	restored, content = restore("refs/heads/master", "deps-0000000000000004")
+	assert.Equal(t, "deps-0000000000000003", restored)
+	assert.Equal(t, "newer", content)
+
+	// The least recently used cache is evicted first, even though it was
+	// saved after the oldest one
+	files, err := filepath.Glob(filepath.Join(dir, "caches", "*", "*", "*", "*.tar.gz"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(files))
+	total := int64(0)
+	for _, filename := range files {
+		fi, err := os.Stat(filename)
+		assert.Nil(t, err)
+		total += fi.Size()
+	}
+	store.maxsize = total - 1
+	store.evict()
+	feature := filepath.Join(dir, "caches", "owner", "repo", "refs%2Fheads%2Ffeature")
+	_, err = os.Stat(filepath.Join(feature, "deps-0000000000000002.tar.gz"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(feature, "deps-0000000000000002.tar.gz.used"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(master, "deps-0000000000000001.tar.gz"))
+	assert.Nil(t, err)
+}
+
+func TestExtractCacheStaysWithinPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+
+	tarball := func(headers ...*tar.Header) *bytes.Buffer {
+		buf := &bytes.Buffer{}
+		gz := gzip.NewWriter(buf)
+		tw := tar.NewWriter(gz)
+		for _, header := range headers {
+			if header.Typeflag == tar.TypeReg {
+				header.Mode, header.Size = 0644, 1
+			}
+			assert.Nil(t, tw.WriteHeader(header))
+			if header.Typeflag == tar.TypeReg {
+				tw.Write([]byte("x"))
+			}
+		}
+		tw.Close()
+		gz.Close()
+		return buf
+	}
+
+	// Symlinks within the path are kept
+	err = extractCache(tarball(
+		&tar.Header{Name: "0/pkg/bin", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "0/bin", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "0/bin/tool", Typeflag: tar.TypeSymlink, Linkname: "../pkg/bin"},
+	), []string{root})
+	assert.Nil(t, err)
+	content, err := ioutil.ReadFile(filepath.Join(root, "bin", "tool"))
+	assert.Nil(t, err)
+	assert.Equal(t, "x", string(content))
+
+	for _, headers := range [][]*tar.Header{
+		{{Name: "0/escape", Typeflag: tar.TypeSymlink, Linkname: "../outside"}},
+		{{Name: "0/escape", Typeflag: tar.TypeSymlink, Linkname: dir}},
+		{{Name: "0", Typeflag: tar.TypeSymlink, Linkname: "outside"}},
+	} {
+		assert.NotNil(t, extractCache(tarball(headers...), []string{root}), headers[0].Linkname)
+	}
+
+	// Files are never written through a symlink leading out of the path
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "outside"), 0755))
+	assert.Nil(t, os.Symlink(filepath.Join(dir, "outside"), filepath.Join(root, "link")))
+	err = extractCache(tarball(&tar.Header{Name: "0/link/file", Typeflag: tar.TypeReg}), []string{root})
+	assert.NotNil(t, err)
+	_, err = os.Stat(filepath.Join(dir, "outside", "file"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	REPO_CONFIG_FILE = ".jarvis.json"
+
+	TTY_DEFAULT_COLUMNS = 120
+	TTY_DEFAULT_ROWS    = 40
+)
+
+// RepoConfig is the pipeline configuration committed at the root of a
+// repository. Every field is optional.
+type RepoConfig struct {
+	// Submodules makes the checkout recursively initialize the submodules.
+	Submodules bool `json:"submodules"`
+
+	// LFS makes the checkout fetch the Git LFS objects of the commit.
+	LFS bool `json:"lfs"`
+
+	// Secure holds values encrypted with `jarvis-ci encrypt`, each decrypting
+	// to a NAME=value pair exported to every target.
+	Secure []string `json:"secure"`
+
+	// ProblemMatchers are the matchers of the repository, applied along with
+	// the built-in ones to the targets that do not pick their own.
+	ProblemMatchers []ProblemMatcher `json:"problem_matchers"`
+
+	Targets map[string]TargetConfig `json:"targets"`
+}
+
+type TargetConfig struct {
+	// Secure holds encrypted NAME=value pairs exported to this target only.
+	Secure []string `json:"secure"`
+
+	// Artifacts are globs, relative to the root of the repository, of the
+	// files kept after the target ran. Directories are kept whole.
+	Artifacts []string `json:"artifacts"`
+
+	// Caches are directories restored before the target and saved after it.
+	Caches []CacheConfig `json:"caches"`
+
+	// TTY runs the target under a pseudo-terminal of TTYColumns by TTYRows,
+	// 120 by 40 by default, merging its stdout and stderr.
+	TTY        bool `json:"tty"`
+	TTYColumns int  `json:"tty_columns"`
+	TTYRows    int  `json:"tty_rows"`
+
+	// Timeout is the duration after which the target is killed, such as
+	// "30m". Targets have no timeout by default.
+	Timeout string `json:"timeout"`
+
+	// Matchers are the names of the problem matchers applied to the output,
+	// built-in or of the repository. All of them are applied by default, and
+	// none if it is empty.
+	Matchers []string `json:"matchers"`
+
+	// Reports are globs, relative to the root of the repository, of the JUnit
+	// XML reports written by the target.
+	Reports []string `json:"reports"`
+
+	// GoTestJSON marks the output of the target as the one of go test -json,
+	// to read the results of its tests from.
+	GoTestJSON bool `json:"go_test_json"`
+}
+
+// LoadRepoConfig reads the pipeline configuration of the repository cloned
+// in dir. A repository without one gets the empty configuration.
+func LoadRepoConfig(dir string) (RepoConfig, error) {
+	config := RepoConfig{}
+	content, err := ioutil.ReadFile(filepath.Join(dir, REPO_CONFIG_FILE))
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return config, err
+	}
+
+	err = json.Unmarshal(content, &config)
+	if err != nil {
+		return config, fmt.Errorf("Failed to parse %s: %v", REPO_CONFIG_FILE, err)
+	}
+	for name, target := range config.Targets {
+		if _, err := target.TimeoutDuration(); err != nil {
+			return config, fmt.Errorf("Invalid timeout of target %s: %v", name, err)
+		}
+		matchers, err := config.Matchers(name)
+		if err == nil {
+			_, err = newProblemMatchers(matchers, name, dir)
+		}
+		if err != nil {
+			return config, fmt.Errorf("Invalid problem matchers of target %s: %v", name, err)
+		}
+	}
+	return config, nil
+}
+
+// Target returns the configuration of the target.
+func (c RepoConfig) Target(target string) TargetConfig {
+	return c.Targets[target]
+}
+
+// Matchers returns the problem matchers applied to the output of the
+// target.
+func (c RepoConfig) Matchers(target string) ([]ProblemMatcher, error) {
+	all := append(append([]ProblemMatcher{}, BuiltinMatchers...), c.ProblemMatchers...)
+	names := c.Target(target).Matchers
+	if names == nil {
+		return all, nil
+	}
+
+	matchers := []ProblemMatcher{}
+	for _, name := range names {
+		found := false
+		for _, matcher := range all {
+			if matcher.Name == name {
+				matchers = append(matchers, matcher)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown problem matcher %s", name)
+		}
+	}
+	return matchers, nil
+}
+
+// TTYSize returns the size of the pseudo-terminal of the target.
+func (c TargetConfig) TTYSize() (int, int) {
+	columns, rows := c.TTYColumns, c.TTYRows
+	if columns <= 0 {
+		columns = TTY_DEFAULT_COLUMNS
+	}
+	if rows <= 0 {
+		rows = TTY_DEFAULT_ROWS
+	}
+	return columns, rows
+}
+
+// TimeoutDuration parses the timeout of the target, zero if it has none.
+func (c TargetConfig) TimeoutDuration() (time.Duration, error) {
+	if c.Timeout == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(c.Timeout)
+}
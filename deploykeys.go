@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/google/go-github/github"
+)
+
+// GITHUB_KNOWN_HOSTS are the SSH host keys published by GitHub, written to
+// -known-hosts when it does not exist.
+const GITHUB_KNOWN_HOSTS = `github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl
+github.com ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBEmKSENjQEezOmxkZMy7opKgwFB9nkt5YRrYMjNuG5N87uRgg6CLrbo5wAdT/y6v0mKV0U2w0WZ2YB/++Tpockg=
+github.com ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQCj7ndNxQowgcQnjshcLrqPEiiphnt+VTTvDP6mHBL9j1aNUkY4Ue1gvwnGLVlOhGeYrnZaMgRK6+PKCUXaDbC7qtbW8gIkhL7aGCsOr/C56SJMy/BCZfxd1nWzAOxSDPgVsmerOBYfNqltV9/hWCqBywINIR+5dIg6JTJ72pcEpEjcYgXkE2YEFXV1JHnsKgbLWNlhScqb2UmyRkQyytRLtL+38TGxkxCflmO+5Z8CSSNY7GidjMIZ7Q4zMjA2n1nGrlTDkzwDCsw+wqFPGQA179cnfGWOWRVruj16z6XyvxvjJwbz0wQZ75XK5tKSb7FNyeIEs4TT4jk+S4dhPeAUC5y+bDYirYgM4GC7uEnztnZyaVWQ7B381AK4Qdrwt51ZqExKbQpTUNn+EjqoTwvqNj4kqx5QUCI0ThS/YkOxJCXmPUWZbhjpCg56i+2aB6CmK2JGhn57K5mj0MNdBXA4/WnwH6XoPWJzK5Nyu2zB3nAZp+S5hpQs+p1vN1/wsjk=
+`
+
+var (
+	DeployKeysDir      string
+	KnownHostsPath     string
+	GenerateDeployKeys bool
+)
+
+func init() {
+	flag.StringVar(&DeployKeysDir, "deploy-keys-dir", "/jarvis-ci/deploykeys", "The directory holding the SSH deploy key of the repositories, as owner/repo")
+	flag.StringVar(&KnownHostsPath, "known-hosts", "/jarvis-ci/known_hosts", "The known_hosts file pinning the host keys of GitHub")
+	flag.BoolVar(&GenerateDeployKeys, "generate-deploy-keys", false, "Whether to generate and register a deploy key for repositories without one")
+}
+
+// deployKeys finds the SSH deploy key of a repository, generating it and
+// registering it on GitHub if asked to.
+type deployKeys struct {
+	dir      string
+	generate bool
+	client   *GithubClient
+	lock     *sync.Mutex
+}
+
+func DefaultDeployKeys(client *GithubClient) *deployKeys {
+	return NewDeployKeys(DeployKeysDir, GenerateDeployKeys, client)
+}
+
+func NewDeployKeys(dir string, generate bool, client *GithubClient) *deployKeys {
+	keys := &deployKeys{}
+	keys.dir = dir
+	keys.generate = generate
+	keys.client = client
+	keys.lock = &sync.Mutex{}
+	return keys
+}
+
+// Key returns the path to the private deploy key of the repository, or an
+// empty string if the repository has none. The host keys of GitHub are
+// pinned in -known-hosts before any key is used.
+func (d *deployKeys) Key(repo string) (string, error) {
+	keypath, err := d.key(repo)
+	if err != nil || keypath == "" {
+		return keypath, err
+	}
+	err = WriteKnownHosts(KnownHostsPath)
+	if err != nil {
+		return "", fmt.Errorf("Failed to write known hosts %s: %v", KnownHostsPath, err)
+	}
+	return keypath, nil
+}
+
+func (d *deployKeys) key(repo string) (string, error) {
+	parts := strings.Split(repo, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || parts[0] == ".." || parts[1] == ".." {
+		return "", fmt.Errorf("Invalid repository name: %s", repo)
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	keypath := filepath.Join(d.dir, parts[0], parts[1])
+	if _, err := os.Stat(keypath); err == nil {
+		return keypath, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	} else if !d.generate {
+		return "", nil
+	}
+
+	// Generate a new key and register its public half as a read-only deploy key
+	glog.Infof("Generating deploy key for %s", repo)
+	err := os.MkdirAll(filepath.Dir(keypath), 0700)
+	if err != nil {
+		return "", err
+	}
+	out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "jarvis-ci", "-f", keypath).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("Failed to generate deploy key: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	pub, err := ioutil.ReadFile(keypath + ".pub")
+	if err != nil {
+		return "", err
+	}
+
+	key := &github.Key{}
+	key.Title = github.String("jarvis-ci")
+	key.Key = github.String(strings.TrimSpace(string(pub)))
+	key.ReadOnly = github.Bool(true)
+	_, _, err = d.client.Repositories.CreateKey(context.Background(), parts[0], parts[1], key)
+	if err != nil {
+		os.Remove(keypath)
+		os.Remove(keypath + ".pub")
+		return "", fmt.Errorf("Failed to register deploy key: %v", err)
+	}
+	return keypath, nil
+}
+
+// WriteKnownHosts writes the host keys of GitHub to the known_hosts file,
+// unless it already exists.
+func WriteKnownHosts(path string) error {
+	if _, err := os.Stat(path); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(GITHUB_KNOWN_HOSTS), 0644)
+}
+
+// SSHCommand returns the GIT_SSH_COMMAND using the key and the pinned host
+// keys. The known_hosts path is also quoted for ssh, which splits the
+// option on whitespace.
+func SSHCommand(keypath string) string {
+	return fmt.Sprintf("ssh -i %s -o IdentitiesOnly=yes -o %s -o StrictHostKeyChecking=yes",
+		shellQuote(keypath), shellQuote(`UserKnownHostsFile="`+KnownHostsPath+`"`))
+}
+
+// shellQuote quotes the string as a single word for sh, which git runs
+// GIT_SSH_COMMAND with.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
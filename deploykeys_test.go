@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeployKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy keys")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(path string) { KnownHostsPath = path }(KnownHostsPath)
+	KnownHostsPath = filepath.Join(dir, "ssh", "known hosts")
+
+	keys := NewDeployKeys(filepath.Join(dir, "keys"), false, nil)
+	keypath, err := keys.Key("owner/repo")
+	assert.Nil(t, err)
+	assert.Equal(t, "", keypath)
+	_, err = keys.Key("../repo")
+	assert.NotNil(t, err)
+
+	// The host keys of GitHub are pinned along with the first key used
+	keyfile := filepath.Join(dir, "keys", "owner", "it's")
+	assert.Nil(t, os.MkdirAll(filepath.Dir(keyfile), 0700))
+	assert.Nil(t, ioutil.WriteFile(keyfile, []byte("key"), 0600))
+	keypath, err = keys.Key("owner/it's")
+	assert.Nil(t, err)
+	assert.Equal(t, keyfile, keypath)
+	content, err := ioutil.ReadFile(KnownHostsPath)
+	assert.Nil(t, err)
+	assert.Equal(t, GITHUB_KNOWN_HOSTS, string(content))
+
+	// The paths survive the shell git runs the command with
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh is not installed")
+	}
+	out, err := exec.Command("sh", "-c", SSHCommand(keypath)+" -G github.com").CombinedOutput()
+	assert.Nil(t, err, string(out))
+	assert.Contains(t, string(out), "identityfile "+keyfile+"\n")
+	assert.Contains(t, string(out), "userknownhostsfile "+KnownHostsPath+"\n")
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/groupcache/lru"
+)
+
+const (
+	OUTPUT_STORE_MEMORY = "memory"
+	OUTPUT_STORE_DISK   = "disk"
+
+	OUTPUT_INDEX_FILE = "index.jsonl"
+)
+
+var (
+	OutputStore string
+	OutputsDir  string
+)
+
+var validJobID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func init() {
+	flag.StringVar(&OutputStore, "output-store", OUTPUT_STORE_MEMORY, "Where to keep the build outputs: memory, or disk to keep them across restarts")
+	flag.StringVar(&OutputsDir, "outputs-dir", "/jarvis-ci/outputs", "The directory of the build outputs when stored on disk")
+}
+
+// NewOutputHandlerFromFlags creates the output handler selected by -output-store.
+func NewOutputHandlerFromFlags() (OutputHandler, error) {
+	switch OutputStore {
+	case OUTPUT_STORE_MEMORY:
+		return DefaultOutputHandler(), nil
+	case OUTPUT_STORE_DISK:
+		return NewDiskOutputHandler(OutputsDir, OutputCacheSize)
+	}
+	return nil, fmt.Errorf("Unknown output store: %s", OutputStore)
+}
+
+type outputIndexEntry struct {
+	JobID   string    `json:"jobid"`
+	File    string    `json:"file"`
+	Created time.Time `json:"created"`
+}
+
+// diskOutputHandler appends the records of every job to its own file and
+// records the files in an append-only index. The outputs of running jobs are
+// kept open in memory until they are closed, and recently read outputs are
+// kept in an LRU cache if its size is positive.
+type diskOutputHandler struct {
+	dir   string
+	index map[string]outputIndexEntry
+	open  map[string]*diskOutput
+	cache *lru.Cache
+	lock  *sync.Mutex
+}
+
+// diskOutput is the open file of the output of a running job, along with
+// the records written to it.
+type diskOutput struct {
+	file    *os.File
+	records []LogRecord
+}
+
+var _ OutputHandler = &diskOutputHandler{}
+
+func NewDiskOutputHandler(dir string, cachesize int) (*diskOutputHandler, error) {
+	handler := &diskOutputHandler{}
+	handler.dir = dir
+	handler.index = map[string]outputIndexEntry{}
+	handler.open = map[string]*diskOutput{}
+	handler.lock = &sync.Mutex{}
+	if cachesize > 0 {
+		handler.cache = lru.New(cachesize)
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = handler.loadIndex()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load output index: %v", err)
+	}
+	return handler, nil
+}
+
+func (h *diskOutputHandler) loadIndex() error {
+	f, err := os.Open(filepath.Join(h.dir, OUTPUT_INDEX_FILE))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			entry := outputIndexEntry{}
+			if jerr := json.Unmarshal(line, &entry); jerr != nil {
+				glog.Warningf("Skipping corrupted output index entry: %v", jerr)
+			} else {
+				h.index[entry.JobID] = entry
+			}
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// entry returns the index entry of the job, adding it to the index first if
+// create is set.
+func (h *diskOutputHandler) entry(jobid string, create bool) (outputIndexEntry, error) {
+	if entry, ok := h.index[jobid]; ok || !create {
+		return entry, nil
+	}
+	if !validJobID.MatchString(jobid) {
+		return outputIndexEntry{}, fmt.Errorf("Invalid job id: %s", jobid)
+	}
+
+	entry := outputIndexEntry{jobid, jobid + ".jsonl", time.Now()}
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return entry, err
+	}
+	f, err := os.OpenFile(filepath.Join(h.dir, OUTPUT_INDEX_FILE), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return entry, err
+	}
+	defer f.Close()
+	_, err = f.Write(append(content, '\n'))
+	if err != nil {
+		return entry, err
+	}
+	h.index[jobid] = entry
+	return entry, nil
+}
+
+func (h *diskOutputHandler) AddOutput(jobid string, target string, stream string, text string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	output, err := h.openOutput(jobid)
+	if err != nil {
+		glog.Errorf("Failed to open output of %s: %v", jobid, err)
+		return
+	}
+
+	// Number the lines after the ones already written
+	records := newRecords(jobid, target, stream, text, len(output.records))
+	output.records = append(output.records, records...)
+	err = writeJSONL(output.file, records)
+	if err != nil {
+		glog.Errorf("Failed to write output of %s: %v", jobid, err)
+	}
+}
+
+// openOutput returns the open output of the job, opening its file and
+// reading the records already written to it if it is not open yet.
+func (h *diskOutputHandler) openOutput(jobid string) (*diskOutput, error) {
+	if output, ok := h.open[jobid]; ok {
+		return output, nil
+	}
+	entry, err := h.entry(jobid, true)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(h.dir, entry.File), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	output := &diskOutput{f, h.readOutput(entry)}
+	if h.cache != nil {
+		h.cache.Remove(jobid)
+	}
+	h.open[jobid] = output
+	return output, nil
+}
+
+func (h *diskOutputHandler) GetOutput(jobid string) []LogRecord {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if output, ok := h.open[jobid]; ok {
+		return output.records[:len(output.records):len(output.records)]
+	}
+	if h.cache != nil {
+		if val, ok := h.cache.Get(jobid); ok {
+			return val.([]LogRecord)
+		}
+	}
+
+	entry, _ := h.entry(jobid, false)
+	if entry.File == "" {
+		return []LogRecord{}
+	}
+	records := h.readOutput(entry)
+	if h.cache != nil {
+		h.cache.Add(jobid, records)
+	}
+	return records
+}
+
+// CloseOutput closes the file of the job, keeping its records in the cache.
+func (h *diskOutputHandler) CloseOutput(jobid string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	output, ok := h.open[jobid]
+	if !ok {
+		return
+	}
+	delete(h.open, jobid)
+	err := output.file.Close()
+	if err != nil {
+		glog.Errorf("Failed to close output of %s: %v", jobid, err)
+	}
+	if h.cache != nil {
+		h.cache.Add(jobid, output.records)
+	}
+}
+
+// readOutput reads the records of the output file, skipping the lines that
+// are not records such as one cut short by a crash.
+func (h *diskOutputHandler) readOutput(entry outputIndexEntry) []LogRecord {
+	records := []LogRecord{}
+	f, err := os.Open(filepath.Join(h.dir, entry.File))
+	if os.IsNotExist(err) {
+		return records
+	} else if err != nil {
+		glog.Errorf("Failed to read output of %s: %v", entry.JobID, err)
+		return records
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		record := LogRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			glog.Warningf("Skipping invalid record of %s: %v", entry.JobID, err)
+			continue
+		}
+		record.Line = len(records) + 1
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		glog.Errorf("Failed to read output of %s: %v", entry.JobID, err)
+	}
+	return records
+}
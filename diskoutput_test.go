@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskOutputHandlerSurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outputs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	handler, err := NewDiskOutputHandler(dir, 2)
+	assert.Nil(t, err)
+	handler.AddOutput("job-1", "", STREAM_JARVIS, "first 1%")
+	assert.Equal(t, "first 1%", handler.GetOutput("job-1")[0].Text)
+	handler.AddOutput("job-1", "test", STREAM_STDERR, "second")
+
+	handler, err = NewDiskOutputHandler(dir, 0)
+	assert.Nil(t, err)
+	handler.AddOutput("job-1", "test", STREAM_STDOUT, "third")
+	records := handler.GetOutput("job-1")
+	assert.Equal(t, 3, len(records))
+	assert.Equal(t, LogRecord{records[1].Time, "job-1", "test", STREAM_STDERR, 2, "second"}, records[1])
+	assert.Equal(t, 3, records[2].Line)
+	assert.Equal(t, 0, len(handler.GetOutput("job-2")))
+}
+
+func TestDiskOutputHandlerSkipsInvalidRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outputs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	index := `{"jobid":"job-1","file":"job-1.jsonl","created":"2017-01-01T00:00:00Z"}` + "\n"
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, OUTPUT_INDEX_FILE), []byte(index), 0644))
+	output := `{"job":"job-1","stream":"jarvis","line":1,"text":"JOB: job-1"}` + "\n" + `{"job":"job-1","str`
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "job-1.jsonl"), []byte(output), 0644))
+
+	handler, err := NewDiskOutputHandler(dir, 0)
+	assert.Nil(t, err)
+	records := handler.GetOutput("job-1")
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, "JOB: job-1", records[0].Text)
+	assert.Equal(t, 1, records[0].Line)
+}
+
+func TestDiskOutputHandlerClosesOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outputs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	handler, err := NewDiskOutputHandler(dir, 2)
+	assert.Nil(t, err)
+	handler.AddOutput("job-1", "", STREAM_JARVIS, "first")
+	handler.AddOutput("job-1", "", STREAM_JARVIS, "second")
+	assert.Equal(t, 1, len(handler.open))
+
+	// The records of a running job are not read back from its file
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "job-1.jsonl"), nil, 0644))
+	assert.Equal(t, 2, len(handler.GetOutput("job-1")))
+
+	handler.CloseOutput("job-1")
+	assert.Equal(t, 0, len(handler.open))
+	assert.Equal(t, "second", handler.GetOutput("job-1")[1].Text)
+
+	handler.AddOutput("job-2", "", STREAM_JARVIS, "first")
+	handler.CloseOutput("job-2")
+	handler.AddOutput("job-2", "", STREAM_JARVIS, "second")
+	handler.CloseOutput("job-2")
+	handler, err = NewDiskOutputHandler(dir, 0)
+	assert.Nil(t, err)
+	records := handler.GetOutput("job-2")
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, 2, records[1].Line)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// runEncrypt implements `jarvis-ci encrypt`, which encrypts NAME=value pairs
+// for the secure section of the pipeline configuration of a repository.
+func runEncrypt(args []string) error {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	repo := fs.String("r", "", "The full name of the repository the values are encrypted for")
+	keyfile := fs.String("key", "", "The path to the public key of the repository")
+	keyurl := fs.String("url", "", "The URL to fetch the public key of the repository from")
+	fs.Usage = func() {
+		fmt.Println("Usage: jarvis-ci encrypt -r owner/repo (-key FILE | -url URL) NAME=value...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *repo == "" || fs.NArg() == 0 || (*keyfile == "") == (*keyurl == "") {
+		fs.Usage()
+		return fmt.Errorf("Missing arguments")
+	}
+
+	// Read the public key
+	var content []byte
+	var err error
+	if *keyfile != "" {
+		content, err = ioutil.ReadFile(*keyfile)
+	} else {
+		content, err = fetchPublicKey(*keyurl)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read public key: %v", err)
+	}
+	pub, err := ParsePublicKey(content)
+	if err != nil {
+		return err
+	}
+
+	for _, value := range fs.Args() {
+		if !strings.Contains(value, "=") {
+			return fmt.Errorf("Values must be of the form NAME=value")
+		}
+		encrypted, err := EncryptValue(pub, *repo, value)
+		if err != nil {
+			return fmt.Errorf("Failed to encrypt value: %v", err)
+		}
+		fmt.Println(encrypted)
+	}
+	return nil
+}
+
+func fetchPublicKey(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Bad status code: %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
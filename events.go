@@ -1,17 +1,18 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/google/go-github/github"
 )
 
 type EventHandler interface {
-	OnPushEvent(event *github.PushEvent) error
+	OnPushEvent(event *github.PushEvent, payload []byte) error
+	OnPullRequestEvent(event *github.PullRequestEvent, payload []byte) error
 	OnPingEvent(event *github.PingEvent) error
 }
 
@@ -19,6 +20,16 @@ type eventHandler struct {
 	client        *GithubClient
 	reponame      string
 	outputhandler OutputHandler
+	secrets       SecretStore
+	keys          *repoKeys
+	mirrors       *mirrorCache
+	deploykeys    *deployKeys
+	artifacts     *artifactStore
+	workspaces    *workspacePool
+	caches        *cacheStore
+	jobs          JobStore
+	archiver      *archiver
+	values        func() []string
 
 	MasterRef string
 }
@@ -39,122 +50,491 @@ func init() {
 	flag.StringVar(&MasterRef, "master-ref", "refs/heads/master", "The ref with post-commit targets. Defaults to refs/heads/master")
 }
 
-func NewEventHandler(reponame string, client *GithubClient, outputhandler OutputHandler) *eventHandler {
+func NewEventHandler(reponame string, client *GithubClient, outputhandler OutputHandler, secrets SecretStore, keys *repoKeys, artifacts *artifactStore, jobs JobStore, archiver *archiver, values func() []string) *eventHandler {
 	h := &eventHandler{}
 	h.client = client
 	h.reponame = reponame
 	h.outputhandler = outputhandler
+	h.secrets = secrets
+	h.keys = keys
+	h.mirrors = DefaultMirrorCache()
+	h.deploykeys = DefaultDeployKeys(client)
+	h.artifacts = artifacts
+	h.workspaces = DefaultWorkspacePool()
+	h.caches = DefaultCacheStore()
+	h.jobs = jobs
+	h.archiver = archiver
+	h.values = values
 	h.MasterRef = MasterRef
 	return h
 }
 
-func (h *eventHandler) OnPushEvent(event *github.PushEvent) error {
+func (h *eventHandler) OnPushEvent(event *github.PushEvent, payload []byte) error {
 	glog.Infof("Received push event")
 	if err := checkPushEvent(event); err != nil {
 		return err
 	}
 
-	head, fullName := *event.HeadCommit.ID, *event.Repo.FullName
+	fullName := *event.Repo.FullName
 	if h.reponame != REPONAME_ANY && fullName != h.reponame {
 		return fmt.Errorf("Will not handle requests for this repository: %s", fullName)
 	}
+	return h.runJob(NewPushJob(event, payload), event.HeadCommit.GetMessage())
+}
+
+// OnPullRequestEvent builds the head commit of pull requests when they are
+// opened, reopened or pushed to.
+func (h *eventHandler) OnPullRequestEvent(event *github.PullRequestEvent, payload []byte) error {
+	glog.Infof("Received pull request event")
+	if err := checkPullRequestEvent(event); err != nil {
+		return err
+	}
+	switch event.GetAction() {
+	case "opened", "reopened", "synchronize":
+	default:
+		glog.Infof("Ignoring pull request event: %s", event.GetAction())
+		return nil
+	}
+
+	fullName := event.PullRequest.Base.Repo.GetFullName()
+	if h.reponame != REPONAME_ANY && fullName != h.reponame {
+		return fmt.Errorf("Will not handle requests for this repository: %s", fullName)
+	}
+	return h.runJob(NewPullRequestJob(event, payload), "")
+}
+
+// runJob clones the commit of the job and runs its targets: jarvis-ci-test,
+// then the targets listed in the commit message when it is pushed to the
+// master ref.
+func (h *eventHandler) runJob(job *Job, message string) error {
+	head, fullName := job.Commit, job.Repo
+	job.OutputURL = h.client.OutputURL(job.ID)
+	h.saveJob(job)
 
-	// TODO: REMOVE THIS
-	content, _ := json.Marshal(event)
-	fmt.Println(string(content))
+	// Any early return is an error of jarvis rather than a failed target
+	state := JOB_ERROR
+	defer func() {
+		job.Finish(state)
+		h.reportAnnotations(job)
+		h.archiveJob(job)
+		h.outputhandler.CloseOutput(job.ID)
+		h.saveJob(job)
+	}()
 
 	// Get a new job runner
 	runner := NewRunner()
+	runner.UseMirrors(h.mirrors)
+	runner.UseToken(h.client.Token())
 	defer runner.Cleanup()
 
-	err := h.client.PostStatus(fullName, head, head, "pending", "jarvis-ci-test")
+	// Export the job information to the targets
+	err := runner.SetJob(job)
+	if err != nil {
+		glog.Warningf("Failed to set job information: %v", err)
+	}
+
+	// Build branches in their persistent workspace if enabled
+	if h.workspaces != nil && job.Branch() != "" && !job.Fork {
+		dir, release, err := h.workspaces.Acquire(fullName, job.Branch())
+		if err != nil {
+			glog.Warningf("Failed to acquire workspace: %v", err)
+		} else {
+			runner.UseWorkspace(dir, release)
+		}
+	}
+
+	job.Start()
+	h.saveJob(job)
+	h.logf(job, "", "JOB: %s %s@%s (%s)", job.ID, job.Repo, job.Ref, job.Commit)
+	err = h.postStatus(job, "pending", "jarvis-ci-test")
 	if err != nil {
 		glog.Warningf("Failed to create pending status: %v", err)
 	}
 
-	// Construct the clone URL
-	prefix := h.client.BaseURL()
-	cloneURL := fmt.Sprintf("%s/%s.git", prefix, fullName)
+	// Construct the clone URL, using the deploy key of the repository if any
+	cloneURL := fmt.Sprintf("%s/%s.git", h.client.BaseURL(), fullName)
+	keypath, err := h.deploykeys.Key(fullName)
+	if err != nil {
+		glog.Warningf("Failed to get deploy key of %s: %v", fullName, err)
+	} else if keypath != "" {
+		cloneURL = fmt.Sprintf("git@github.com:%s.git", fullName)
+		runner.UseSSHKey(keypath)
+	}
 
 	// Clone repository
-	err = runner.CloneRepo(cloneURL, event.GetRef())
+	err = runner.CloneRepo(cloneURL, job.Ref, head)
 	if err != nil {
-		h.outputhandler.AddOutput(head, "Failed to clone repo: %v", err)
-		h.client.PostStatus(fullName, head, head, "failure", "jarvis-ci-test")
+		h.logf(job, "", "Failed to clone repo: %v", err)
+		h.postStatus(job, "failure", "jarvis-ci-test")
 		return err
 	}
 
 	// Checkout head commit
 	err = runner.Checkout(head)
 	if err != nil {
-		h.outputhandler.AddOutput(head, "Failed to checkout head: %v", err)
-		h.client.PostStatus(fullName, head, head, "failure", "jarvis-ci-test")
+		h.logf(job, "", "Failed to checkout head: %v", err)
+		h.postStatus(job, "failure", "jarvis-ci-test")
 		return err
 	}
 
-	// Write the head of the output
-	h.outputhandler.AddOutput(head, "TARGET: jarvis-ci-test\n-------")
+	// Read the pipeline configuration
+	config, err := LoadRepoConfig(runner.clonedir)
+	if err != nil {
+		h.logf(job, "", "Failed to load pipeline configuration: %v", err)
+		h.postStatus(job, "failure", "jarvis-ci-test")
+		return err
+	}
 
-	// Append to the output continuously
-	fn := func(line string) error {
-		line = strings.Replace(line, "%", "%%", -1)
-		h.outputhandler.AddOutput(head, line)
-		return nil
+	// Initialize the submodules
+	if config.Submodules {
+		start := time.Now()
+		err = runner.UpdateSubmodules()
+		if err != nil {
+			h.logf(job, "", "%v", err)
+			h.postStatus(job, "failure", "jarvis-ci-test")
+			return err
+		}
+		h.logf(job, "", "Updated submodules in %v", time.Since(start))
 	}
-	err = runner.WatchFn(fn, "make", "jarvis-ci-test")
-	if err != nil {
-		h.outputhandler.AddOutput(head, "-------\n%v", err)
+
+	// Fetch the LFS objects
+	if config.LFS {
+		start := time.Now()
+		err = runner.PullLFS()
+		if err != nil {
+			h.logf(job, "", "%v", err)
+			h.postStatus(job, "failure", "jarvis-ci-test")
+			return err
+		}
+		h.logf(job, "", "Pulled LFS objects in %v", time.Since(start))
 	}
 
-	// Append footer for main target
-	h.outputhandler.AddOutput(head, "=======\n")
+	// Run the main target
+	err = h.runTarget(runner, job, config, "jarvis-ci-test")
 
 	// Handle the error now
+	state = JOB_FAILURE
 	if err != nil {
-		h.client.PostStatus(fullName, head, head, "failure", "jarvis-ci-test")
+		h.postStatus(job, "failure", "jarvis-ci-test")
 		glog.Infof("Failed jarvis-ci-test: %v", err)
 		return nil
 	}
 
-	h.client.PostStatus(fullName, head, head, "success", "jarvis-ci-test")
+	h.postStatus(job, "success", "jarvis-ci-test")
 
 	// Check if the ref is the master ref
-	if h.MasterRef != event.GetRef() {
+	if h.MasterRef != job.Ref || job.Trigger != TRIGGER_PUSH {
+		state = JOB_SUCCESS
 		return nil
 	}
 
 	// Parse the head commit message to find make targets
-	msg := event.HeadCommit.GetMessage()
 	targets := []string{}
-	for _, line := range strings.Split(msg, "\n") {
+	for _, line := range strings.Split(message, "\n") {
 		if strings.HasPrefix(line, "JARVIS: ") {
 			targetstring := strings.TrimPrefix(line, "JARVIS: ")
 			targets = append(targets, strings.Split(targetstring, " ")...)
 		}
 	}
 
+	failed := false
 	for _, target := range targets {
-		h.outputhandler.AddOutput(head, "TARGET: %s\n-------", target)
-		err = runner.WatchFn(fn, "make", target)
+		err = h.runTarget(runner, job, config, target)
 		if err != nil {
 			glog.Infof("Failed %s: %v", target, err)
-			h.outputhandler.AddOutput(head, "ERROR: %v", err)
-			h.client.PostStatus(fullName, head, head, "failure", target)
+			h.postStatus(job, "failure", target)
+			failed = true
 		} else {
 			glog.Infof("Success %s", target)
-			h.client.PostStatus(fullName, head, head, "success", target)
+			h.postStatus(job, "success", target)
 		}
-		h.outputhandler.AddOutput(head, "=======\n")
+	}
+	if !failed {
+		state = JOB_SUCCESS
 	}
 	return nil
 }
 
+// postStatus posts the status of the target of the job to GitHub and
+// records it on the job. The status describes the results of the tests of
+// the target, if any were reported.
+func (h *eventHandler) postStatus(job *Job, state string, target string) error {
+	job.AddStatus(target, state)
+	description := testSummary(job.TargetTests(target))
+	if description == "" {
+		description = "Makefile target: " + target
+	}
+	return h.client.PostStatus(job.Repo, job.Commit, job.ID, state, target, description)
+}
+
+// logf appends a message of jarvis to the output of the target of the job,
+// or of the job itself when target is empty.
+func (h *eventHandler) logf(job *Job, target string, format string, args ...interface{}) {
+	h.outputhandler.AddOutput(job.ID, target, STREAM_JARVIS, fmt.Sprintf(format, args...))
+}
+
+// saveJob records the current state of the job.
+func (h *eventHandler) saveJob(job *Job) {
+	err := h.jobs.Save(job)
+	if err != nil {
+		glog.Errorf("Failed to save job %s: %v", job.ID, err)
+	}
+}
+
+// archiveJob uploads the log and the artifacts of the finished job if
+// archiving is enabled.
+func (h *eventHandler) archiveJob(job *Job) {
+	if h.archiver == nil {
+		return
+	}
+	err := h.archiver.Archive(job, h.outputhandler.GetOutput(job.ID), h.artifacts)
+	if err != nil {
+		glog.Errorf("Failed to archive job %s: %v", job.ID, err)
+	}
+}
+
+// runTarget runs the make target, streaming its output, and collects the
+// results of its tests and its artifacts.
+func (h *eventHandler) runTarget(runner *Runner, job *Job, config RepoConfig, target string) error {
+	jobid := job.ID
+
+	// Append to the output continuously, annotating the problems it reports
+	var problems *problemMatchers
+	matchers, err := config.Matchers(target)
+	if err == nil {
+		problems, err = newProblemMatchers(matchers, target, runner.clonedir)
+	}
+	if err != nil {
+		h.logf(job, target, "Failed to load problem matchers: %v", err)
+	}
+	options := config.Target(target)
+	gotest := newGoTestParser()
+	fn := func(stream, line string) error {
+		h.writeLine(job, target, problems, stream, line)
+		if options.GoTestJSON && stream == STREAM_STDOUT {
+			gotest.Add(line)
+		}
+		return nil
+	}
+	err = removeJUnitReports(runner.clonedir, options.Reports)
+	if err != nil {
+		h.logf(job, target, "Failed to remove old test reports: %v", err)
+	}
+	caches := config.Target(target).Caches
+	keys := h.restoreCaches(runner, job, target, caches)
+	run := job.StartTarget(target)
+	h.saveJob(job)
+	runner.SetTarget(target, h.targetEnv(job, config, target)...)
+	if options.TTY {
+		runner.UseTTY(options.TTYSize())
+	}
+	timeout, _ := config.Target(target).TimeoutDuration()
+	runner.SetTimeout(timeout)
+	err = runner.WatchStreamFn(fn, "make", target)
+	h.collectTests(runner, job, target, options, gotest)
+	job.FinishTarget(run, err)
+	h.saveJob(job)
+	if err != nil {
+		h.logf(job, target, "ERROR: %v", err)
+	} else {
+		h.saveCaches(runner, job, target, caches, keys)
+	}
+
+	// Keep the artifacts, even of failed targets
+	patterns := config.Target(target).Artifacts
+	if len(patterns) > 0 {
+		artifacts, aerr := h.artifacts.Collect(jobid, runner.clonedir, patterns)
+		for _, artifact := range artifacts {
+			h.logf(job, target, "ARTIFACT: %s (%d bytes) %s/jobs/%s/artifacts/%s",
+				artifact.Path, artifact.Size, BasePath, jobid, artifact.Path)
+		}
+		if aerr != nil {
+			h.logf(job, target, "Failed to collect artifacts: %v", aerr)
+		}
+	}
+	return err
+}
+
+// collectTests records the results of the tests of the target, read from
+// its reports and its go test -json output, with their secrets masked.
+func (h *eventHandler) collectTests(runner *Runner, job *Job, target string, options TargetConfig, gotest *goTestParser) {
+	results, err := loadJUnitReports(runner.clonedir, options.Reports)
+	if err != nil {
+		h.logf(job, target, "Failed to read test reports: %v", err)
+	}
+	if options.GoTestJSON {
+		results = append(results, gotest.Results()...)
+	}
+	values := h.values()
+	for i := range results {
+		results[i].Message = MaskSecrets(results[i].Message, values)
+	}
+	if len(results) > 0 {
+		job.AddTests(target, results)
+		h.logf(job, target, "TESTS: %s", testSummary(results))
+	}
+}
+
+// writeLine appends a line of the target to the output of the job, acting
+// on the output commands among them: groups are recorded as such, and
+// annotations are added to the job, as are the problems matched in the
+// other lines, both with their secrets masked.
+func (h *eventHandler) writeLine(job *Job, target string, problems *problemMatchers, stream string, line string) {
+	command, ok := parseOutputCommand(line)
+	if !ok {
+		h.outputhandler.AddOutput(job.ID, target, stream, line)
+		for _, annotation := range problems.Match(line) {
+			job.AddAnnotation(h.maskAnnotation(annotation))
+		}
+		return
+	}
+
+	switch command.Name {
+	case "group":
+		h.outputhandler.AddOutput(job.ID, target, STREAM_GROUP, command.Value)
+	case "endgroup":
+		h.outputhandler.AddOutput(job.ID, target, STREAM_ENDGROUP, "")
+	default:
+		annotation := h.maskAnnotation(command.annotation(target))
+		job.AddAnnotation(annotation)
+		h.outputhandler.AddOutput(job.ID, target, stream, annotation.String())
+	}
+}
+
+// maskAnnotation replaces the secrets found in the title and the message of
+// the annotation, as they are in the output.
+func (h *eventHandler) maskAnnotation(a Annotation) Annotation {
+	values := h.values()
+	a.Title = MaskSecrets(a.Title, values)
+	a.Message = MaskSecrets(a.Message, values)
+	return a
+}
+
+// reportAnnotations comments the annotations of files on the commit of the
+// job, if enabled. Commits are only commented once, so that rebuilds do not
+// repeat the annotations.
+func (h *eventHandler) reportAnnotations(job *Job) {
+	if !AnnotationComments {
+		return
+	}
+	body := annotationsComment(job)
+	if body == "" {
+		return
+	}
+	commented, err := h.client.HasCommitComment(job.Repo, job.Commit, ANNOTATIONS_COMMENT_MARKER)
+	if err != nil {
+		glog.Errorf("Failed to list the comments of %s: %v", job.Commit, err)
+		return
+	} else if commented {
+		glog.Infof("Annotations of %s were already reported", job.Commit)
+		return
+	}
+	err = h.client.CommentCommit(job.Repo, job.Commit, body)
+	if err != nil {
+		glog.Errorf("Failed to report annotations of %s: %v", job.ID, err)
+	}
+}
+
+// restoreCaches restores the dependency caches of a target. It returns, for
+// every cache, the key it should be saved under after the target, empty if
+// the cache was restored from that exact key.
+func (h *eventHandler) restoreCaches(runner *Runner, job *Job, target string, caches []CacheConfig) []string {
+	keys := make([]string, len(caches))
+	for i, cache := range caches {
+		key, err := h.caches.Key(runner.clonedir, cache)
+		if err != nil {
+			h.logf(job, target, "Invalid cache %s: %v", cache.Key, err)
+			continue
+		}
+
+		start := time.Now()
+		restored, err := h.caches.Restore(job.Repo, job.Ref, h.MasterRef, runner.clonedir, runner.home, key, cache)
+		if err != nil {
+			h.logf(job, target, "%v", err)
+		} else if restored == "" {
+			h.logf(job, target, "No cache found for %s", key)
+		} else {
+			h.logf(job, target, "Restored cache %s in %v", restored, time.Since(start))
+		}
+		if restored != key {
+			keys[i] = key
+		}
+	}
+	return keys
+}
+
+// saveCaches saves the caches that were not restored from their exact key.
+// Builds of forks never save caches.
+func (h *eventHandler) saveCaches(runner *Runner, job *Job, target string, caches []CacheConfig, keys []string) {
+	if job.Fork {
+		return
+	}
+	for i, cache := range caches {
+		if keys[i] == "" {
+			continue
+		}
+		start := time.Now()
+		err := h.caches.Save(job.Repo, job.Ref, runner.clonedir, runner.home, keys[i], cache)
+		if err != nil {
+			h.logf(job, target, "Failed to save cache %s: %v", keys[i], err)
+			continue
+		}
+		h.logf(job, target, "Saved cache %s in %v", keys[i], time.Since(start))
+	}
+}
+
+// targetEnv returns the secrets of the target as environment variables,
+// both the ones from the secret store and the encrypted ones from the
+// pipeline configuration.
+func (h *eventHandler) targetEnv(job *Job, config RepoConfig, target string) []string {
+	env := []string{}
+	secrets, err := h.secrets.Secrets(job, target)
+	if err != nil {
+		glog.Errorf("Failed to get secrets for %s: %v", target, err)
+		h.logf(job, target, "Failed to load secrets: %v", err)
+	}
+	for _, secret := range secrets {
+		env = append(env, secret.Name+"="+secret.Value)
+	}
+
+	// Encrypted values are only ever decrypted for the repository owning them
+	secure := append(append([]string{}, config.Secure...), config.Target(target).Secure...)
+	if len(secure) == 0 {
+		return env
+	} else if job.Fork {
+		h.logf(job, target, "Not decrypting secure values for a fork")
+		return env
+	}
+	for _, value := range secure {
+		decrypted, err := h.keys.Decrypt(job.Repo, value)
+		if err != nil {
+			h.logf(job, target, "Failed to decrypt secure value: %v", err)
+			continue
+		}
+		env = append(env, decrypted)
+	}
+	return env
+}
+
 func (h *eventHandler) OnPingEvent(event *github.PingEvent) error {
 	glog.Infof("Received ping event")
 	return nil
 }
 
 // Make sure every field exists
+func checkPullRequestEvent(event *github.PullRequestEvent) error {
+	if event.PullRequest == nil {
+		return fmt.Errorf("Missing PullRequestEvent.PullRequest")
+	}
+	if event.PullRequest.Base == nil || event.PullRequest.Base.Repo == nil || event.PullRequest.Base.Repo.FullName == nil {
+		return fmt.Errorf("Missing PullRequestEvent base repo full name")
+	}
+	if event.PullRequest.Head == nil || event.PullRequest.Head.SHA == nil {
+		return fmt.Errorf("Missing PullRequestEvent head commit ID")
+	}
+	return nil
+}
+
 func checkPushEvent(event *github.PushEvent) error {
 	if event.Repo == nil {
 		return fmt.Errorf("Missing PushEvent.Repo")
@@ -8,4 +8,13 @@ func printFlags() {
 	glog.Infof("Token path: %s", TokenPath)
 	glog.Infof("Hub secret path: %s", HubSecretPath)
 	glog.Infof("Repository full name: %s", RepoFullName)
+	glog.Infof("Secrets directory: %s", SecretsDir)
+	glog.Infof("Keys directory: %s", KeysDir)
+	glog.Infof("Mirror directory: %s", MirrorDir)
+	glog.Infof("Deploy keys directory: %s", DeployKeysDir)
+	glog.Infof("Artifacts directory: %s", ArtifactsDir)
+	glog.Infof("Workspaces directory: %s", WorkspacesDir)
+	glog.Infof("Caches directory: %s", CachesDir)
+	glog.Infof("Output store: %s (%s)", OutputStore, OutputsDir)
+	glog.Infof("Archive: %s/%s", ArchiveEndpoint, ArchiveBucket)
 }
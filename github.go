@@ -27,7 +27,7 @@ func NewGithubClient(token string, baseurl string) *GithubClient {
 	return &GithubClient{token, baseurl, client}
 }
 
-func (c *GithubClient) PostStatus(fullName, head, jobid string, status, target string) error {
+func (c *GithubClient) PostStatus(fullName, head, jobid string, status, target, description string) error {
 	// Create request
 	url := fmt.Sprintf("https://api.github.com/repos/%s/statuses/%s", fullName, head)
 
@@ -35,8 +35,8 @@ func (c *GithubClient) PostStatus(fullName, head, jobid string, status, target s
 	data := map[string]string{}
 	data["context"] = "ci/jarvis-ci/" + target
 	data["state"] = status
-	data["target_url"] = c.baseurl + jobid
-	data["description"] = "Makefile target: " + target
+	data["target_url"] = c.OutputURL(jobid)
+	data["description"] = description
 	dataString, _ := json.Marshal(data)
 
 	// Make the request
@@ -50,16 +50,60 @@ func (c *GithubClient) PostStatus(fullName, head, jobid string, status, target s
 	if err != nil {
 		return err
 	} else if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("Failed to post pending status, bad status code: %s", resp.StatusCode)
+		return fmt.Errorf("Failed to post pending status, bad status code: %d", resp.StatusCode)
 	}
 
 	glog.Infof("Successfully set status of %s/%s to %s (link: %s)", fullName, head, status, data["target_url"])
 	return nil
 }
 
-func (c *GithubClient) BaseURL() string {
-	if len(c.token) == 0 {
-		return fmt.Sprintf("https://github.com")
+// CommentCommit posts the comment on the commit.
+func (c *GithubClient) CommentCommit(fullName, sha, body string) error {
+	parts := strings.SplitN(fullName, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid repository name: %s", fullName)
+	}
+	comment := &github.RepositoryComment{Body: &body}
+	_, _, err := c.Repositories.CreateComment(context.Background(), parts[0], parts[1], sha, comment)
+	return err
+}
+
+// HasCommitComment returns whether a comment on the commit starts with the
+// marker, listing the comments only until the first one that does.
+func (c *GithubClient) HasCommitComment(fullName, sha, marker string) (bool, error) {
+	parts := strings.SplitN(fullName, "/", 2)
+	if len(parts) != 2 {
+		return false, fmt.Errorf("Invalid repository name: %s", fullName)
+	}
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		comments, resp, err := c.Repositories.ListCommitComments(context.Background(), parts[0], parts[1], sha, opt)
+		if err != nil {
+			return false, err
+		}
+		for _, comment := range comments {
+			if strings.HasPrefix(comment.GetBody(), marker) {
+				return true, nil
+			}
+		}
+		if resp.NextPage == 0 {
+			return false, nil
+		}
+		opt.Page = resp.NextPage
 	}
-	return fmt.Sprintf("https://%s@github.com", c.token)
+}
+
+// BaseURL returns the prefix of the clone URLs. The token is never part of
+// it, git gets it through AskpassEnv instead.
+func (c *GithubClient) BaseURL() string {
+	return "https://github.com"
+}
+
+func (c *GithubClient) Token() string {
+	return c.token
+}
+
+// OutputURL returns the link to the build output of a job.
+func (c *GithubClient) OutputURL(jobid string) string {
+	return c.baseurl + jobid
 }
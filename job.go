@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+const (
+	JOB_PENDING = "pending"
+	JOB_RUNNING = "running"
+	JOB_SUCCESS = "success"
+	JOB_FAILURE = "failure"
+	JOB_ERROR   = "error"
+
+	TRIGGER_PUSH         = "push"
+	TRIGGER_PULL_REQUEST = "pull_request"
+)
+
+// Job is one build of a commit. Its ID is unique, so that outputs, statuses
+// and artifacts of two builds of the same commit never mix. It is exported to
+// every command of the job through environment variables.
+type Job struct {
+	ID        string `json:"id"`
+	Repo      string `json:"repo"`
+	Ref       string `json:"ref"`
+	Commit    string `json:"commit"`
+	Trigger   string `json:"trigger"`
+	OutputURL string `json:"output_url"`
+	PRNumber  int    `json:"pr_number,omitempty"`
+	Payload   []byte `json:"-"`
+
+	// Fork is set for pull requests from another repository, whose builds
+	// get no secrets and never write to the workspaces or the caches.
+	Fork bool `json:"fork"`
+
+	State       string         `json:"state"`
+	Targets     []*TargetRun   `json:"targets"`
+	Statuses    []StatusUpdate `json:"statuses"`
+	Annotations []Annotation   `json:"annotations"`
+	Tests       []TestResult   `json:"tests"`
+	Created     time.Time      `json:"created"`
+	Started     time.Time      `json:"started"`
+	Finished    time.Time      `json:"finished"`
+
+	// LogLocation is where the log of the job is kept when it is not in the
+	// output store.
+	LogLocation string `json:"log_location,omitempty"`
+
+	lock *sync.Mutex
+}
+
+// TargetRun is the run of one make target within a job.
+type TargetRun struct {
+	Name     string    `json:"name"`
+	State    string    `json:"state"`
+	ExitCode int       `json:"exit_code"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// StatusUpdate is a commit status posted to GitHub for the job.
+type StatusUpdate struct {
+	Target string    `json:"target"`
+	State  string    `json:"state"`
+	Time   time.Time `json:"time"`
+}
+
+func NewJob(trigger string) *Job {
+	job := &Job{}
+	job.ID = newJobID()
+	job.Trigger = trigger
+	job.State = JOB_PENDING
+	job.Created = time.Now()
+	job.lock = &sync.Mutex{}
+	return job
+}
+
+// NewPushJob creates the job of the head commit of a push. Pushes are made
+// to the repository itself, so they are never builds of forks, even when
+// that repository is a fork on GitHub.
+func NewPushJob(event *github.PushEvent, payload []byte) *Job {
+	job := NewJob(TRIGGER_PUSH)
+	job.Repo = event.Repo.GetFullName()
+	job.Ref = event.GetRef()
+	job.Commit = event.HeadCommit.GetID()
+	job.Payload = payload
+	return job
+}
+
+// NewPullRequestJob creates the job of the head commit of a pull request,
+// built in the base repository. Pull requests whose head is in another
+// repository are builds of forks.
+func NewPullRequestJob(event *github.PullRequestEvent, payload []byte) *Job {
+	pr := event.PullRequest
+	job := NewJob(TRIGGER_PULL_REQUEST)
+	job.Repo = pr.Base.Repo.GetFullName()
+	job.Ref = fmt.Sprintf("refs/pull/%d/head", pr.GetNumber())
+	job.Commit = pr.Head.GetSHA()
+	job.PRNumber = pr.GetNumber()
+	job.Fork = pr.Head.Repo == nil || pr.Head.Repo.GetFullName() != job.Repo
+	job.Payload = payload
+	return job
+}
+
+// Branch returns the short name of the ref if it is a branch, empty otherwise.
+func (j *Job) Branch() string {
+	if !strings.HasPrefix(j.Ref, "refs/heads/") {
+		return ""
+	}
+	return strings.TrimPrefix(j.Ref, "refs/heads/")
+}
+
+// Env returns the environment variables describing this job, along with
+// the number of its pull request if it builds one.
+func (j *Job) Env() []string {
+	env := []string{
+		"CI=true",
+		"JARVIS=true",
+		"JARVIS_JOB_ID=" + j.ID,
+		"JARVIS_REPO=" + j.Repo,
+		"JARVIS_REF=" + j.Ref,
+		"JARVIS_BRANCH=" + j.Branch(),
+		"JARVIS_COMMIT=" + j.Commit,
+		"JARVIS_OUTPUT_URL=" + j.OutputURL,
+	}
+	if j.PRNumber > 0 {
+		env = append(env, fmt.Sprintf("JARVIS_PR_NUMBER=%d", j.PRNumber))
+	}
+	return env
+}
+
+// Start marks the job as running.
+func (j *Job) Start() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.State = JOB_RUNNING
+	j.Started = time.Now()
+}
+
+// Finish marks the job as done with the state.
+func (j *Job) Finish(state string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.State = state
+	j.Finished = time.Now()
+}
+
+// Done returns whether the job finished, whatever its outcome.
+func (j *Job) Done() bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.State != JOB_PENDING && j.State != JOB_RUNNING
+}
+
+// StartTarget records that the target started running.
+func (j *Job) StartTarget(name string) *TargetRun {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	run := &TargetRun{Name: name, State: JOB_RUNNING, Started: time.Now()}
+	j.Targets = append(j.Targets, run)
+	return run
+}
+
+// FinishTarget records the outcome of the target from the error of its command.
+func (j *Job) FinishTarget(run *TargetRun, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	run.Finished = time.Now()
+	run.ExitCode = exitCode(err)
+	run.State = JOB_SUCCESS
+	if err != nil {
+		run.State = JOB_FAILURE
+	}
+}
+
+// AddStatus records a commit status posted for the job.
+func (j *Job) AddStatus(target string, state string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.Statuses = append(j.Statuses, StatusUpdate{target, state, time.Now()})
+}
+
+// AddAnnotation records an annotation of one of the targets of the job.
+func (j *Job) AddAnnotation(annotation Annotation) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.Annotations = append(j.Annotations, annotation)
+}
+
+// AddTests records the results of the tests of the target.
+func (j *Job) AddTests(target string, results []TestResult) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	for _, result := range results {
+		result.Target = target
+		j.Tests = append(j.Tests, result)
+	}
+}
+
+// TargetTests returns the results of the tests of the target.
+func (j *Job) TargetTests(target string) []TestResult {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	results := []TestResult{}
+	for _, result := range j.Tests {
+		if result.Target == target {
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// SetLogLocation records where the log of the job was archived.
+func (j *Job) SetLogLocation(location string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.LogLocation = location
+}
+
+// Snapshot returns a copy of the job safe to read while it keeps running.
+func (j *Job) Snapshot() Job {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	snapshot := *j
+	snapshot.Targets = []*TargetRun{}
+	for _, run := range j.Targets {
+		copied := *run
+		snapshot.Targets = append(snapshot.Targets, &copied)
+	}
+	snapshot.Statuses = append([]StatusUpdate{}, j.Statuses...)
+	snapshot.Annotations = append([]Annotation{}, j.Annotations...)
+	snapshot.Tests = append([]TestResult{}, j.Tests...)
+	snapshot.lock = &sync.Mutex{}
+	return snapshot
+}
+
+// exitCode returns the exit code of a command from the error it returned,
+// -1 if it did not exit normally.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exiterr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return -1
+}
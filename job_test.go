@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-github/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPullRequestJob(t *testing.T) {
+	payload := []byte(`{"action": "opened", "number": 7, "pull_request": {"number": 7,
+		"head": {"sha": "abc", "repo": {"full_name": "someone/repo"}},
+		"base": {"sha": "def", "repo": {"full_name": "owner/repo"}}}}`)
+	event := &github.PullRequestEvent{}
+	assert.Nil(t, json.Unmarshal(payload, event))
+	assert.Nil(t, checkPullRequestEvent(event))
+
+	job := NewPullRequestJob(event, payload)
+	assert.Equal(t, TRIGGER_PULL_REQUEST, job.Trigger)
+	assert.Equal(t, "owner/repo", job.Repo)
+	assert.Equal(t, "refs/pull/7/head", job.Ref)
+	assert.Equal(t, "abc", job.Commit)
+	assert.Equal(t, 7, job.PRNumber)
+	assert.Equal(t, "", job.Branch())
+	assert.Contains(t, job.Env(), "JARVIS_PR_NUMBER=7")
+	assert.True(t, job.Fork)
+
+	// Pull requests between branches of the repository are trusted
+	event.PullRequest.Head.Repo.FullName = github.String("owner/repo")
+	assert.False(t, NewPullRequestJob(event, payload).Fork)
+}
+
+func TestNewPushJobOfForkedRepository(t *testing.T) {
+	payload := []byte(`{"ref": "refs/heads/master", "head_commit": {"id": "abc"},
+		"repository": {"full_name": "someone/repo", "fork": true}}`)
+	event := &github.PushEvent{}
+	assert.Nil(t, json.Unmarshal(payload, event))
+	assert.Nil(t, checkPushEvent(event))
+
+	// A fork pushing to itself builds with its own secrets and workspaces
+	job := NewPushJob(event, payload)
+	assert.Equal(t, "someone/repo", job.Repo)
+	assert.Equal(t, "master", job.Branch())
+	assert.False(t, job.Fork)
+}
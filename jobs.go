@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+)
+
+const (
+	JOB_STORE_MEMORY = "memory"
+	JOB_STORE_SQL    = "sql"
+)
+
+type JobStore interface {
+	// Save adds the job or records its current state.
+	Save(job *Job) error
+
+	// Get returns the job with the ID, nil if there is none.
+	Get(id string) (*Job, error)
+
+	// List returns the jobs matching the filter, most recent first.
+	List(filter JobFilter) ([]*Job, error)
+}
+
+// JobFilter selects jobs, empty fields matching every job.
+type JobFilter struct {
+	Repo   string
+	Branch string
+	State  string
+	Limit  int
+	Offset int
+}
+
+func (f JobFilter) Match(job *Job) bool {
+	return (f.Repo == "" || f.Repo == job.Repo) &&
+		(f.Branch == "" || f.Branch == job.Branch()) &&
+		(f.State == "" || f.State == job.State)
+}
+
+// LastJob returns the most recent job of the branch in the state, such as
+// the last green build of master, nil if there is none.
+func LastJob(store JobStore, repo string, branch string, state string) (*Job, error) {
+	jobs, err := store.List(JobFilter{Repo: repo, Branch: branch, State: state, Limit: 1})
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+	return jobs[0], nil
+}
+
+type memoryJobStore struct {
+	jobs  map[string]*Job
+	order []string
+	size  int
+	lock  *sync.Mutex
+}
+
+var (
+	JobStoreType   string
+	JobHistorySize int
+	JobDBDriver    string
+	JobDBSource    string
+)
+
+var _ JobStore = &memoryJobStore{}
+
+func init() {
+	flag.StringVar(&JobStoreType, "job-store", JOB_STORE_MEMORY, "Where to keep the job history: memory or sql")
+	flag.IntVar(&JobHistorySize, "job-history", 1000, "Number of jobs to keep in memory")
+	flag.StringVar(&JobDBDriver, "job-db-driver", SQL_DRIVER_SQLITE, "The database driver of the sql job store: sqlite3 or postgres")
+	flag.StringVar(&JobDBSource, "job-db", "/jarvis-ci/jobs.db", "The data source of the sql job store")
+}
+
+// NewJobStoreFromFlags creates the job store selected by -job-store.
+func NewJobStoreFromFlags() (JobStore, error) {
+	switch JobStoreType {
+	case JOB_STORE_MEMORY:
+		return DefaultJobStore(), nil
+	case JOB_STORE_SQL:
+		return NewSQLJobStore(JobDBDriver, JobDBSource)
+	}
+	return nil, fmt.Errorf("Unknown job store: %s", JobStoreType)
+}
+
+func DefaultJobStore() *memoryJobStore {
+	return NewMemoryJobStore(JobHistorySize)
+}
+
+func NewMemoryJobStore(size int) *memoryJobStore {
+	store := &memoryJobStore{}
+	store.jobs = map[string]*Job{}
+	store.size = size
+	store.lock = &sync.Mutex{}
+	return store
+}
+
+func (s *memoryJobStore) Save(job *Job) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.jobs[job.ID]; !ok {
+		s.order = append(s.order, job.ID)
+	}
+	s.jobs[job.ID] = job
+
+	// Forget the oldest jobs
+	for len(s.order) > s.size {
+		delete(s.jobs, s.order[0])
+		s.order = s.order[1:]
+	}
+	return nil
+}
+
+func (s *memoryJobStore) Get(id string) (*Job, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, nil
+	}
+	snapshot := job.Snapshot()
+	return &snapshot, nil
+}
+
+func (s *memoryJobStore) List(filter JobFilter) ([]*Job, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	jobs := []*Job{}
+	skipped := 0
+	for i := len(s.order) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(jobs) >= filter.Limit {
+			break
+		}
+		snapshot := s.jobs[s.order[i]].Snapshot()
+		if !filter.Match(&snapshot) {
+			continue
+		} else if skipped < filter.Offset {
+			skipped++
+			continue
+		}
+		jobs = append(jobs, &snapshot)
+	}
+	return jobs, nil
+}
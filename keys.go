@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	REPO_KEY_BITS = 2048
+)
+
+var (
+	KeysDir string
+)
+
+func init() {
+	flag.StringVar(&KeysDir, "keys-dir", "/jarvis-ci/keys", "The directory holding the private key of every repository")
+}
+
+// repoKeys owns one RSA keypair per repository. Values are encrypted with a
+// random AES key, itself encrypted with the public key of the repository
+// using the name of the repository as label, so that a value can only be
+// decrypted for the repository it was encrypted for.
+type repoKeys struct {
+	dir    string
+	keys   map[string]*rsa.PrivateKey
+	values map[string]bool
+	lock   *sync.Mutex
+}
+
+func DefaultRepoKeys() *repoKeys {
+	return NewRepoKeys(KeysDir)
+}
+
+func NewRepoKeys(dir string) *repoKeys {
+	keys := &repoKeys{}
+	keys.dir = dir
+	keys.keys = map[string]*rsa.PrivateKey{}
+	keys.values = map[string]bool{}
+	keys.lock = &sync.Mutex{}
+	return keys
+}
+
+// filename returns the file of the private key of the repository.
+func (k *repoKeys) filename(repo string) (string, error) {
+	parts := strings.Split(repo, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || parts[0] == ".." || parts[1] == ".." {
+		return "", fmt.Errorf("Invalid repository name: %s", repo)
+	}
+	return filepath.Join(k.dir, parts[0], parts[1]+".pem"), nil
+}
+
+// Exists returns whether the repository already has a key.
+func (k *repoKeys) Exists(repo string) bool {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if _, ok := k.keys[repo]; ok {
+		return true
+	}
+	filename, err := k.filename(repo)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filename)
+	return err == nil
+}
+
+// key returns the private key of the repository, generating it the first
+// time it is needed.
+func (k *repoKeys) key(repo string) (*rsa.PrivateKey, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if key, ok := k.keys[repo]; ok {
+		return key, nil
+	}
+
+	filename, err := k.filename(repo)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err == nil {
+		block, _ := pem.Decode(content)
+		if block == nil {
+			return nil, fmt.Errorf("Failed to decode private key %s", filename)
+		}
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse private key %s: %v", filename, err)
+		}
+		k.keys[repo] = key
+		return key, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, REPO_KEY_BITS)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate key for %s: %v", repo, err)
+	}
+	err = os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return nil, err
+	}
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	err = ioutil.WriteFile(filename, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to save key for %s: %v", repo, err)
+	}
+	k.keys[repo] = key
+	return key, nil
+}
+
+// PublicKey returns the PEM encoded public key of the repository.
+func (k *repoKeys) PublicKey(repo string) ([]byte, error) {
+	key, err := k.key(repo)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// Decrypt decrypts a value encrypted for the repository.
+func (k *repoKeys) Decrypt(repo string, value string) (string, error) {
+	key, err := k.key(repo)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(data) < key.Size() {
+		return "", fmt.Errorf("Malformed encrypted value")
+	}
+
+	aeskey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, data[:key.Size()], []byte(repo))
+	if err != nil {
+		return "", fmt.Errorf("Failed to decrypt value, was it encrypted for %s?", repo)
+	}
+	gcm, err := newGCM(aeskey)
+	if err != nil {
+		return "", err
+	}
+	data = data[key.Size():]
+	if len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("Malformed encrypted value")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("Failed to decrypt value: %v", err)
+	}
+
+	k.lock.Lock()
+	k.values[string(plain)] = true
+	k.lock.Unlock()
+	return string(plain), nil
+}
+
+// Values returns every value decrypted so far so that they can be masked,
+// along with the part after the = of those long enough to be secrets.
+func (k *repoKeys) Values() []string {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	values := []string{}
+	for value := range k.values {
+		values = append(values, value)
+		if i := strings.Index(value, "="); i >= 0 && len(value)-i-1 >= SECRET_MIN_LENGTH {
+			values = append(values, value[i+1:])
+		}
+	}
+	return values
+}
+
+// EncryptValue encrypts the value for the repository owning the public key.
+func EncryptValue(pub *rsa.PublicKey, repo string, value string) (string, error) {
+	aeskey := make([]byte, 32)
+	if _, err := rand.Read(aeskey); err != nil {
+		return "", err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, aeskey, []byte(repo))
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newGCM(aeskey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	data := append(encryptedKey, nonce...)
+	data = gcm.Seal(data, nonce, []byte(value), nil)
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// ParsePublicKey parses a PEM encoded public key.
+func ParsePublicKey(content []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("Failed to decode public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsapub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Public key is not an RSA key")
+	}
+	return rsapub, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// STREAM_JARVIS is the stream of the messages of jarvis itself.
+	STREAM_JARVIS = "jarvis"
+
+	LOG_FORMAT_TEXT  = "text"
+	LOG_FORMAT_JSONL = "jsonl"
+	LOG_FORMAT_HTML  = "html"
+)
+
+// LogRecord is one line of the output of a job. Lines are numbered from 1
+// across the whole job.
+type LogRecord struct {
+	Time   time.Time `json:"time"`
+	JobID  string    `json:"job"`
+	Target string    `json:"target,omitempty"`
+	Stream string    `json:"stream"`
+	Line   int       `json:"line"`
+	Text   string    `json:"text"`
+}
+
+// newRecords returns a record for every line of the text, numbered after
+// the lines already in the output of the job.
+func newRecords(jobid string, target string, stream string, text string, lines int) []LogRecord {
+	now := time.Now()
+	records := []LogRecord{}
+	for _, line := range strings.Split(text, "\n") {
+		records = append(records, LogRecord{now, jobid, target, stream, lines + len(records) + 1, line})
+	}
+	return records
+}
+
+// logSection is the part of the output of a job written while running one
+// of its targets, or by jarvis itself around them when Target is empty.
+type logSection struct {
+	Target  string
+	Records []LogRecord
+}
+
+// logSections groups the consecutive records of the same target.
+func logSections(records []LogRecord) []logSection {
+	sections := []logSection{}
+	for _, record := range records {
+		if len(sections) == 0 || sections[len(sections)-1].Target != record.Target {
+			sections = append(sections, logSection{Target: record.Target})
+		}
+		last := &sections[len(sections)-1]
+		last.Records = append(last.Records, record)
+	}
+	return sections
+}
+
+// targetLog returns the records of the target, the last run of it if it ran
+// more than once.
+func targetLog(records []LogRecord, target string) ([]LogRecord, bool) {
+	found := []LogRecord{}
+	ok := false
+	for _, section := range logSections(records) {
+		if section.Target == target && target != "" {
+			found, ok = section.Records, true
+		}
+	}
+	return found, ok
+}
+
+// writeText writes the output as plain text, every target between a header
+// and a footer.
+func writeText(w io.Writer, records []LogRecord) error {
+	for _, section := range logSections(records) {
+		if section.Target != "" {
+			fmt.Fprintf(w, "TARGET: %s\n-------\n", section.Target)
+		}
+		for _, record := range section.Records {
+			prefix := ""
+			switch record.Stream {
+			case STREAM_STDERR:
+				prefix = "[stderr] "
+			case STREAM_GROUP:
+				prefix = "::group::"
+			case STREAM_ENDGROUP:
+				prefix = "::endgroup::"
+			}
+			_, err := fmt.Fprintf(w, "[%s]   %s%s\n", record.Time.Format(time.RFC3339), prefix, record.Text)
+			if err != nil {
+				return err
+			}
+		}
+		if section.Target != "" {
+			fmt.Fprint(w, "=======\n\n")
+		}
+	}
+	return nil
+}
+
+// writeJSONL writes the output as one JSON record per line.
+func writeJSONL(w io.Writer, records []LogRecord) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	for _, record := range records {
+		err := encoder.Encode(record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveOutput writes the output of the job in the format of the request:
+// text by default, jsonl or html. The escape sequences of the text and jsonl
+// formats are kept unless ansi=strip, and download=1 serves them as a file.
+func serveOutput(w http.ResponseWriter, req *http.Request, jobid string, records []LogRecord) {
+	query := req.URL.Query()
+	if query.Get("ansi") == "strip" {
+		stripped := make([]LogRecord, len(records))
+		for i, record := range records {
+			record.Text = StripANSI(record.Text)
+			stripped[i] = record
+		}
+		records = stripped
+	}
+	if query.Get("download") != "" {
+		extension := "log"
+		if query.Get("format") == LOG_FORMAT_JSONL {
+			extension = LOG_FORMAT_JSONL
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", jobid+"."+extension))
+	}
+
+	var err error
+	switch format := query.Get("format"); format {
+	case "", LOG_FORMAT_TEXT:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		err = writeText(w, records)
+	case LOG_FORMAT_JSONL:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		err = writeJSONL(w, records)
+	case LOG_FORMAT_HTML:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = uiTemplates.ExecuteTemplate(w, "log", map[string]interface{}{
+			"Title":    jobid,
+			"Base":     path.Join(BasePath, "/ui"),
+			"JobID":    jobid,
+			"Sections": uiSections(records, nil),
+		})
+	default:
+		http.Error(w, fmt.Sprintf("Unknown format: %s", format), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		glog.Errorf("Failed to write output of %s: %v", jobid, err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"os/exec"
 	"path"
 	"strings"
@@ -37,8 +38,23 @@ func init() {
 }
 
 func main() {
+	// Answer the credential prompts of git
+	if os.Getenv(ASKPASS_ENV) != "" && len(os.Args) == 2 {
+		runAskpass(os.Args[1])
+		return
+	}
+
 	flag.Parse()
 
+	// Run the encrypt subcommand instead of the server
+	if flag.Arg(0) == "encrypt" {
+		err := runEncrypt(flag.Args()[1:])
+		if err != nil {
+			glog.Fatalf("Failed to encrypt: %v", err)
+		}
+		return
+	}
+
 	// Start the cleanup in background
 	go startCleanup()
 
@@ -61,16 +77,55 @@ func main() {
 	// Create the github client
 	client := NewGithubClient(string(token), OutputURI)
 
-	// Create the output handler
-	outputhandler := DefaultOutputHandler()
+	// Load the secrets and the repository keys
+	secrets := DefaultSecretStore()
+	keys := DefaultRepoKeys()
+
+	// Create the archiver of finished jobs
+	archiver, err := DefaultArchiver()
+	if err != nil {
+		glog.Fatalf("Failed to create archiver: %v", err)
+	}
+
+	values := func() []string {
+		values := append(secrets.Values(), keys.Values()...)
+		values = append(values, archiver.Values()...)
+		return append(values, client.Token(), strings.TrimSpace(string(hubSecret)))
+	}
+
+	// Scrub the secrets from the logs
+	err = RedactStderr(values)
+	if err != nil {
+		glog.Warningf("Failed to redact the logs: %v", err)
+	}
+
+	// Create the output handler, masking the secrets
+	store, err := NewOutputHandlerFromFlags()
+	if err != nil {
+		glog.Fatalf("Failed to create output handler: %v", err)
+	}
+	outputhandler := NewBroadcastOutputHandler(NewMaskingOutputHandler(store, values))
+
+	// Create the artifact store
+	artifacts := DefaultArtifactStore()
+
+	// Create the job store
+	jobs, err := NewJobStoreFromFlags()
+	if err != nil {
+		glog.Fatalf("Failed to create job store: %v", err)
+	}
 
 	// Create the event handler
-	eventhandler := NewEventHandler(RepoFullName, client, outputhandler)
+	eventhandler := NewEventHandler(RepoFullName, client, outputhandler, secrets, keys, artifacts, jobs, archiver, values)
 
 	// Start the server
 	http.HandleFunc(path.Join(BasePath, "/debug/status"), debug)
 	http.HandleFunc(path.Join(BasePath, "/hook"), hook(hubSecret, eventhandler))
-	http.HandleFunc(path.Join(BasePath, "/outputs")+"/", outputfunc(outputhandler))
+	http.HandleFunc(path.Join(BasePath, "/outputs")+"/", outputfunc(outputhandler, jobs, archiver))
+	http.HandleFunc(path.Join(BasePath, "/keys")+"/", publickeyfunc(keys, jobs))
+	http.Handle(path.Join(BasePath, "/jobs")+"/", artifacts)
+	http.Handle(path.Join(BasePath, "/ui")+"/", NewWebUI(jobs, outputhandler, artifacts))
+	http.Handle(path.Join(BasePath, "/api/v1")+"/", NewAPIHandler(jobs, outputhandler))
 	err = http.ListenAndServe(fmt.Sprintf(":%d", ServerPort), nil)
 	glog.Fatalf("Error while serving: %v", err)
 }
@@ -86,23 +141,75 @@ func startCleanup() {
 	}()
 }
 
-func outputfunc(outputhandler OutputHandler) http.HandlerFunc {
+func outputfunc(outputhandler *broadcastOutputHandler, jobs JobStore, archiver *archiver) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		glog.Infof("Handling output request: %s", req.URL.Path)
-		jobid := strings.TrimPrefix(req.URL.Path, "/outputs/")
-		out := outputhandler.GetOutput(jobid)
-		if out != "" {
-			fmt.Fprintf(w, out)
+		jobid := strings.TrimPrefix(req.URL.Path, path.Join(BasePath, "/outputs")+"/")
+		jobid = strings.TrimPrefix(jobid, "/outputs/")
+
+		// Follow the output as it is added
+		if strings.HasSuffix(jobid, "/stream") {
+			serveStream(w, req, outputhandler, jobs, strings.TrimSuffix(jobid, "/stream"))
+			return
+		} else if strings.HasSuffix(jobid, "/live") {
+			serveLivePage(w, strings.TrimSuffix(jobid, "/live"))
+			return
+		}
+
+		records := outputhandler.GetOutput(jobid)
+		if len(records) > 0 {
+			serveOutput(w, req, jobid, records)
+		} else if archiver != nil && archived(jobs, jobid) {
+			archiver.ServeLog(w, req, jobid)
 		} else {
 			fmt.Fprintf(w, "No output found for jobid '%s'.", jobid)
 		}
 	}
 }
 
+// archived returns whether the log of the job may be in the archive: it was
+// archived, or the job is unknown to the store, such as the in-memory store
+// after a restart.
+func archived(jobs JobStore, jobid string) bool {
+	job, err := jobs.Get(jobid)
+	if err != nil {
+		glog.Warningf("Failed to get job %s: %v", jobid, err)
+	}
+	return job == nil || job.LogLocation != ""
+}
+
+// publickeyfunc serves the public keys of the repositories. Keys are only
+// generated for the watched repository, or for the ones that already built
+// when watching any, so that anyone cannot make the server generate keys.
+func publickeyfunc(keys *repoKeys, jobs JobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		glog.Infof("Handling public key request: %s", req.URL.Path)
+		repo := strings.TrimPrefix(req.URL.Path, path.Join(BasePath, "/keys")+"/")
+		if RepoFullName != REPONAME_ANY && repo != RepoFullName {
+			http.NotFound(w, req)
+			return
+		} else if RepoFullName == REPONAME_ANY && !keys.Exists(repo) {
+			built, err := jobs.List(JobFilter{Repo: repo, Limit: 1})
+			if err != nil || len(built) == 0 {
+				http.NotFound(w, req)
+				return
+			}
+		}
+
+		key, err := keys.PublicKey(repo)
+		if err != nil {
+			glog.Errorf("Failed to get public key of %s: %v", repo, err)
+			http.Error(w, "No public key for this repository", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Write(key)
+	}
+}
+
 func hook(hubscrt []byte, eventhandler EventHandler) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		glog.Infof("Handling hook request")
-		glog.Infof("Request: %v", req)
+		glog.Infof("Handling hook request: %s %s", req.Method, req.URL.Path)
 
 		// Verify that it's coming from github
 		payload, err := github.ValidatePayload(req, hubscrt)
@@ -129,7 +236,9 @@ func hook(hubscrt []byte, eventhandler EventHandler) http.HandlerFunc {
 			case *github.PingEvent:
 				err = eventhandler.OnPingEvent(event)
 			case *github.PushEvent:
-				err = eventhandler.OnPushEvent(event)
+				err = eventhandler.OnPushEvent(event, payload)
+			case *github.PullRequestEvent:
+				err = eventhandler.OnPullRequestEvent(event, payload)
 			}
 
 			// If there is an error, log it
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ProblemMatcher turns the lines of the output of a target that match its
+// patterns into annotations. The patterns match consecutive lines, the
+// annotation being made of the groups captured by all of them.
+type ProblemMatcher struct {
+	Name     string           `json:"name"`
+	Patterns []ProblemPattern `json:"patterns"`
+
+	// Severity is the level of the annotations that do not capture one,
+	// error by default.
+	Severity string `json:"severity"`
+}
+
+// ProblemPattern is a regular expression along with the indices of the
+// groups it captures, zero for those it does not.
+type ProblemPattern struct {
+	Regexp   string `json:"regexp"`
+	File     int    `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity int    `json:"severity"`
+	Title    int    `json:"title"`
+	Message  int    `json:"message"`
+
+	// Loop makes the last pattern match every following line it can, each
+	// of them an annotation, such as the problems listed under a file.
+	Loop bool `json:"loop"`
+}
+
+// BuiltinMatchers are applied to the targets that do not pick their own.
+var BuiltinMatchers = []ProblemMatcher{
+	{
+		// go build and go vet: ./pkg/file.go:12:3: undefined: x
+		Name: "go",
+		Patterns: []ProblemPattern{{
+			Regexp: `^(?:vet: )?([^\s:]+\.go):(\d+)(?::(\d+))?: (.+)$`,
+			File:   1, Line: 2, Column: 3, Message: 4,
+		}},
+	},
+	{
+		// gcc and clang: src/file.c:12:3: error: message
+		Name: "gcc",
+		Patterns: []ProblemPattern{{
+			Regexp: `^([^\s:]+\.(?:c|cc|cpp|cxx|h|hh|hpp|m|mm)):(\d+):(\d+): (?:fatal )?(error|warning|note): (.+)$`,
+			File:   1, Line: 2, Column: 3, Severity: 4, Message: 5,
+		}},
+	},
+	{
+		// eslint, in its default format: the path of a file followed by its
+		// problems, such as `  12:3  error  'x' is not defined  no-undef`.
+		Name: "eslint",
+		Patterns: []ProblemPattern{{
+			Regexp: `^(/\S+\.(?:js|jsx|mjs|cjs|ts|tsx|vue))$`,
+			File:   1,
+		}, {
+			Regexp: `^\s+(\d+):(\d+)\s+(error|warning)\s+(.+?)(?:\s\s+(\S+))?$`,
+			Line:   1, Column: 2, Severity: 3, Message: 4, Title: 5,
+			Loop: true,
+		}},
+	},
+	{
+		// go test: --- FAIL: TestName (0.00s)
+		Name: "go-test",
+		Patterns: []ProblemPattern{{
+			Regexp:  `^\s*(--- FAIL: (\S+) \(\d+(?:\.\d+)?s\))$`,
+			Message: 1, Title: 2,
+		}},
+	},
+}
+
+// matcherState is the progress of a matcher through its patterns.
+type matcherState struct {
+	matcher ProblemMatcher
+	regexps []*regexp.Regexp
+	next    int
+	partial Annotation
+}
+
+// problemMatchers applies matchers to the lines of the output of a target,
+// one at a time.
+type problemMatchers struct {
+	target string
+	root   string
+	states []*matcherState
+}
+
+// newProblemMatchers compiles the matchers of the output of the target. The
+// paths of files under root are made relative to it.
+func newProblemMatchers(matchers []ProblemMatcher, target string, root string) (*problemMatchers, error) {
+	p := &problemMatchers{target: target, root: root}
+	for _, matcher := range matchers {
+		if len(matcher.Patterns) == 0 {
+			return nil, fmt.Errorf("Problem matcher %s has no patterns", matcher.Name)
+		}
+		state := &matcherState{matcher: matcher}
+		for _, pattern := range matcher.Patterns {
+			re, err := regexp.Compile(pattern.Regexp)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid pattern of problem matcher %s: %v", matcher.Name, err)
+			}
+			state.regexps = append(state.regexps, re)
+		}
+		p.states = append(p.states, state)
+	}
+	return p, nil
+}
+
+// Match returns the annotations completed by the line.
+func (p *problemMatchers) Match(line string) []Annotation {
+	if p == nil {
+		return nil
+	}
+	line = StripANSI(line)
+	annotations := []Annotation{}
+	for _, state := range p.states {
+		if a, ok := p.advance(state, line); ok {
+			annotations = append(annotations, a)
+		}
+	}
+	return annotations
+}
+
+// advance matches the line against the next pattern of the matcher,
+// starting over from its first pattern when it does not match.
+func (p *problemMatchers) advance(state *matcherState, line string) (Annotation, bool) {
+	if state.next > 0 {
+		if a, ok := p.apply(state, line); ok {
+			return a, true
+		} else if state.next > 0 {
+			return Annotation{}, false
+		}
+	}
+	return p.apply(state, line)
+}
+
+// apply matches the line against the next pattern of the matcher, and
+// returns the annotation if it was the last one.
+func (p *problemMatchers) apply(state *matcherState, line string) (Annotation, bool) {
+	pattern := state.matcher.Patterns[state.next]
+	match := state.regexps[state.next].FindStringSubmatch(line)
+	if match == nil {
+		state.next = 0
+		return Annotation{}, false
+	}
+
+	last := state.next == len(state.matcher.Patterns)-1
+	if state.next == 0 {
+		state.partial = Annotation{Target: p.target, Level: matcherLevel(state.matcher.Severity)}
+	}
+	if !last {
+		p.fill(&state.partial, pattern, match)
+		state.next++
+		return Annotation{}, false
+	}
+
+	a := state.partial
+	p.fill(&a, pattern, match)
+	if !pattern.Loop {
+		state.next = 0
+	}
+	return a, a.Message != ""
+}
+
+// fill sets the fields of the annotation captured by the pattern.
+func (p *problemMatchers) fill(a *Annotation, pattern ProblemPattern, match []string) {
+	group := func(i int) string {
+		if i <= 0 || i >= len(match) {
+			return ""
+		}
+		return strings.TrimSpace(match[i])
+	}
+	if file := group(pattern.File); file != "" {
+		a.File = p.relativePath(file)
+	}
+	if line, err := strconv.Atoi(group(pattern.Line)); err == nil {
+		a.Line = line
+	}
+	if column, err := strconv.Atoi(group(pattern.Column)); err == nil {
+		a.Column = column
+	}
+	if severity := group(pattern.Severity); severity != "" {
+		a.Level = matcherLevel(severity)
+	}
+	if title := group(pattern.Title); title != "" {
+		a.Title = title
+	}
+	if message := group(pattern.Message); message != "" {
+		a.Message = message
+	}
+}
+
+// relativePath returns the path of the file relative to the root of the
+// repository, as is if it is outside of it.
+func (p *problemMatchers) relativePath(file string) string {
+	if p.root != "" && filepath.IsAbs(file) {
+		if rel, err := filepath.Rel(p.root, file); err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return strings.TrimPrefix(filepath.ToSlash(file), "./")
+}
+
+// matcherLevel returns the level of the annotations of a severity.
+func matcherLevel(severity string) string {
+	switch strings.ToLower(severity) {
+	case "warning", "warn":
+		return ANNOTATION_WARNING
+	case "notice", "note", "info":
+		return ANNOTATION_NOTICE
+	}
+	return ANNOTATION_ERROR
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuiltinMatchers(t *testing.T) {
+	problems, err := newProblemMatchers(BuiltinMatchers, "test", "/tmp/clone")
+	assert.Nil(t, err)
+
+	lines := []string{
+		"# github.com/owner/repo/cmd",
+		"./cmd/main.go:12:3: undefined: x",
+		"vet: runner.go:40:2: unreachable code",
+		"src/parse.c:7:10: warning: unused variable 'n'",
+		"/tmp/clone/web/app.js",
+		"  3:5   error    'x' is not defined       no-undef",
+		"  9:1   warning  Unexpected console statement  no-console",
+		"",
+		"    main_test.go:20: expected 1",
+		"\x1b[31m--- FAIL: TestParse (0.01s)\x1b[0m",
+		"ok  	github.com/owner/repo	0.01s",
+	}
+	annotations := []Annotation{}
+	for _, line := range lines {
+		annotations = append(annotations, problems.Match(line)...)
+	}
+
+	assert.Equal(t, []Annotation{
+		{Target: "test", Level: ANNOTATION_ERROR, File: "cmd/main.go", Line: 12, Column: 3, Message: "undefined: x"},
+		{Target: "test", Level: ANNOTATION_ERROR, File: "runner.go", Line: 40, Column: 2, Message: "unreachable code"},
+		{Target: "test", Level: ANNOTATION_WARNING, File: "src/parse.c", Line: 7, Column: 10, Message: "unused variable 'n'"},
+		{Target: "test", Level: ANNOTATION_ERROR, File: "web/app.js", Line: 3, Column: 5, Title: "no-undef", Message: "'x' is not defined"},
+		{Target: "test", Level: ANNOTATION_WARNING, File: "web/app.js", Line: 9, Column: 1, Title: "no-console", Message: "Unexpected console statement"},
+		{Target: "test", Level: ANNOTATION_ERROR, Title: "TestParse", Message: "--- FAIL: TestParse (0.01s)"},
+	}, annotations)
+}
+
+func TestRepoMatchers(t *testing.T) {
+	config := RepoConfig{
+		ProblemMatchers: []ProblemMatcher{{
+			Name:     "lint",
+			Severity: "warning",
+			Patterns: []ProblemPattern{{Regexp: `^LINT (\S+) line (\d+): (.*)$`, File: 1, Line: 2, Message: 3}},
+		}},
+		Targets: map[string]TargetConfig{
+			"lint": {Matchers: []string{"lint"}},
+			"none": {Matchers: []string{}},
+			"bad":  {Matchers: []string{"unknown"}},
+		},
+	}
+
+	matchers, err := config.Matchers("test")
+	assert.Nil(t, err)
+	assert.Equal(t, len(BuiltinMatchers)+1, len(matchers))
+	matchers, err = config.Matchers("none")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(matchers))
+	_, err = config.Matchers("bad")
+	assert.NotNil(t, err)
+
+	matchers, _ = config.Matchers("lint")
+	problems, err := newProblemMatchers(matchers, "lint", "")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(problems.Match("./main.go:1:1: ignored")))
+	assert.Equal(t, []Annotation{{Target: "lint", Level: ANNOTATION_WARNING, File: "a.go", Line: 3, Message: "too long"}}, problems.Match("LINT a.go line 3: too long"))
+
+	_, err = newProblemMatchers([]ProblemMatcher{{Name: "broken", Patterns: []ProblemPattern{{Regexp: "("}}}}, "lint", "")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+var (
+	MirrorDir string
+)
+
+func init() {
+	flag.StringVar(&MirrorDir, "mirror-dir", "", "The directory holding the bare mirrors of the repositories, empty to always clone from GitHub")
+}
+
+// mirrorCache keeps a bare mirror of every repository built, so that jobs
+// only need to fetch what changed since the last job instead of cloning.
+type mirrorCache struct {
+	dir   string
+	locks map[string]*sync.Mutex
+	lock  *sync.Mutex
+}
+
+func DefaultMirrorCache() *mirrorCache {
+	if MirrorDir == "" {
+		return nil
+	}
+	return NewMirrorCache(MirrorDir)
+}
+
+func NewMirrorCache(dir string) *mirrorCache {
+	cache := &mirrorCache{}
+	cache.dir = dir
+	cache.locks = map[string]*sync.Mutex{}
+	cache.lock = &sync.Mutex{}
+	return cache
+}
+
+// Path returns the directory of the mirror of the repository at cloneURL,
+// which is either a URL or an scp-like address such as git@github.com:a/b.git.
+func (m *mirrorCache) Path(cloneURL string) (string, error) {
+	host, repopath := "", ""
+	if i := strings.Index(cloneURL, ":"); i >= 0 && !strings.Contains(cloneURL, "://") {
+		host, repopath = cloneURL[:i], cloneURL[i+1:]
+		host = host[strings.LastIndex(host, "@")+1:]
+	} else {
+		u, err := url.Parse(cloneURL)
+		if err != nil {
+			return "", fmt.Errorf("Failed to parse clone URL: %v", err)
+		}
+		host, repopath = u.Host, u.Path
+	}
+
+	name := strings.TrimSuffix(strings.Trim(repopath, "/"), ".git")
+	if name == "" || strings.Contains(name, "..") {
+		return "", fmt.Errorf("Invalid repository path: %s", repopath)
+	}
+	return filepath.Join(m.dir, host, name+".git"), nil
+}
+
+// Lock takes the lock of the mirror, both within this process and against
+// other processes sharing the mirror directory. The returned function
+// releases it.
+func (m *mirrorCache) Lock(mirror string) (func(), error) {
+	m.lock.Lock()
+	lock, ok := m.locks[mirror]
+	if !ok {
+		lock = &sync.Mutex{}
+		m.locks[mirror] = lock
+	}
+	m.lock.Unlock()
+	lock.Lock()
+
+	err := os.MkdirAll(filepath.Dir(mirror), 0700)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	f, err := os.OpenFile(mirror+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		f.Close()
+		lock.Unlock()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+		lock.Unlock()
+	}, nil
+}
+
+// Update creates the mirror if needed and fetches the branches, the tags and
+// the ref into it with a single fetch. The commit sha is fetched on its own
+// if the ref no longer points to it. The mirror must be locked and env is
+// added to the environment of git.
+func (m *mirrorCache) Update(mirror string, cloneURL string, ref string, sha string, env []string) error {
+	if _, err := os.Stat(mirror); os.IsNotExist(err) {
+		glog.Infof("Creating mirror %s", mirror)
+		err = exec.Command("git", "init", "--bare", mirror).Run()
+		if err != nil {
+			return fmt.Errorf("Failed to create mirror: %v", err)
+		}
+	}
+
+	refspecs := []string{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"}
+	if !strings.HasPrefix(ref, "refs/heads/") && !strings.HasPrefix(ref, "refs/tags/") {
+		refspecs = append(refspecs, "+"+ref+":"+ref)
+	}
+
+	glog.Infof("Updating mirror %s", mirror)
+	args := append([]string{"fetch", "--prune", "--quiet", cloneURL}, refspecs...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = mirror
+	cmd.Env = append(os.Environ(), env...)
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Failed to update mirror: %v", err)
+	}
+
+	cmd = exec.Command("git", "cat-file", "-e", sha+"^{commit}")
+	cmd.Dir = mirror
+	if cmd.Run() == nil {
+		return nil
+	}
+	cmd = exec.Command("git", "fetch", "--quiet", cloneURL, sha)
+	cmd.Dir = mirror
+	cmd.Env = append(os.Environ(), env...)
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Failed to fetch %s into mirror: %v", sha, err)
+	}
+	return nil
+}
@@ -2,16 +2,22 @@ package main
 
 import (
 	"flag"
-	"fmt"
 	"sync"
-	"time"
 
 	"github.com/golang/groupcache/lru"
 )
 
 type OutputHandler interface {
-	AddOutput(jobid string, format string, args ...interface{})
-	GetOutput(jobid string) string
+	// AddOutput appends the lines of the text to the output of the job,
+	// recording the target and the stream they were written to.
+	AddOutput(jobid string, target string, stream string, text string)
+
+	// GetOutput returns the records of the output of the job, in order.
+	GetOutput(jobid string) []LogRecord
+
+	// CloseOutput releases what the handler holds for a job that will not
+	// have more output.
+	CloseOutput(jobid string)
 }
 
 type outputHandler struct {
@@ -26,7 +32,7 @@ var (
 var _ OutputHandler = &outputHandler{}
 
 func init() {
-	flag.IntVar(&OutputCacheSize, "output-cache", 20, "Number of build outputs to keep in LRU cache")
+	flag.IntVar(&OutputCacheSize, "output-cache", 20, "Number of build outputs to keep in LRU cache, also the read cache of the disk output store where 0 disables it")
 }
 
 func DefaultOutputHandler() *outputHandler {
@@ -40,25 +46,25 @@ func NewOutputHandler(size int) *outputHandler {
 	return handler
 }
 
-func (h *outputHandler) AddOutput(jobid string, format string, args ...interface{}) {
+func (h *outputHandler) AddOutput(jobid string, target string, stream string, text string) {
 	h.lock.Lock()
 	defer h.lock.Unlock()
-	prefix := fmt.Sprintf("[%s]   ", time.Now().Format(time.RFC3339))
-	val, ok := h.cache.Get(jobid)
-	if !ok {
-		val = prefix + fmt.Sprintf(format, args...)
-	} else {
-		val = val.(string) + "\n" + prefix + fmt.Sprintf(format, args...)
+	records := []LogRecord{}
+	if val, ok := h.cache.Get(jobid); ok {
+		records = val.([]LogRecord)
 	}
-	h.cache.Add(jobid, val)
+	h.cache.Add(jobid, append(records, newRecords(jobid, target, stream, text, len(records))...))
 }
 
-func (h *outputHandler) GetOutput(jobid string) string {
+func (h *outputHandler) GetOutput(jobid string) []LogRecord {
 	h.lock.Lock()
 	defer h.lock.Unlock()
 	val, ok := h.cache.Get(jobid)
 	if !ok {
-		return ""
+		return []LogRecord{}
 	}
-	return val.(string)
+	records := val.([]LogRecord)
+	return records[:len(records):len(records)]
 }
+
+func (h *outputHandler) CloseOutput(jobid string) {}
@@ -0,0 +1,94 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+type winsize struct {
+	rows    uint16
+	columns uint16
+	xpixel  uint16
+	ypixel  uint16
+}
+
+// startPTY starts the command in its own session, its standard streams
+// attached to a new pseudo-terminal of the size. It returns the master side
+// of the terminal, which reads the output of the command.
+func startPTY(cmd *exec.Cmd, columns int, rows int) (*os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unlock the slave side and find its name
+	unlock := int32(0)
+	number := uint32(0)
+	err = ioctl(master, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock)))
+	if err == nil {
+		err = ioctl(master, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&number)))
+	}
+	if err == nil {
+		size := winsize{rows: uint16(rows), columns: uint16(columns)}
+		err = ioctl(master, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&size)))
+	}
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("Failed to set up pseudo-terminal: %v", err)
+	}
+
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", number), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	defer slave.Close()
+
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	err = cmd.Start()
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	return master, nil
+}
+
+// setProcessGroup makes the command start its own process group, for
+// killProcessGroup to also kill its children.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills the command, started by startPTY or with
+// setProcessGroup, along with the processes of its group.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// ioctl runs the request on the file without making it blocking, so that
+// closing it still interrupts its reads.
+func ioctl(f *os.File, request uintptr, arg uintptr) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg)
+	})
+	if err != nil {
+		return err
+	} else if errno != 0 {
+		return errno
+	}
+	return nil
+}
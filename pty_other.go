@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+func startPTY(cmd *exec.Cmd, columns int, rows int) (*os.File, error) {
+	return nil, fmt.Errorf("Pseudo-terminals are not supported on %s", runtime.GOOS)
+}
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	ASKPASS_ENV       = "JARVIS_ASKPASS"
+	ASKPASS_TOKEN_ENV = "JARVIS_ASKPASS_TOKEN"
+)
+
+// AskpassEnv returns the environment making git ask this binary for the
+// GitHub credentials instead of having them in the clone URL.
+func AskpassEnv(token string) []string {
+	if token == "" {
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil
+	}
+	return []string{
+		"GIT_ASKPASS=" + exe,
+		"GIT_TERMINAL_PROMPT=0",
+		ASKPASS_ENV + "=true",
+		ASKPASS_TOKEN_ENV + "=" + token,
+	}
+}
+
+// runAskpass answers the prompt of git when this binary is its GIT_ASKPASS.
+// It fails for the prompts it has no answer for.
+func runAskpass(prompt string) {
+	answer, ok := askpassAnswer(prompt, os.Getenv(ASKPASS_TOKEN_ENV))
+	if !ok {
+		os.Exit(1)
+	}
+	fmt.Println(answer)
+}
+
+// askpassAnswer returns the answer to a prompt of git, such as
+// "Username for 'https://github.com': ". The token is only ever given to
+// GitHub, whatever hosts the submodules of a repository point to.
+func askpassAnswer(prompt string, token string) (string, bool) {
+	start, end := strings.Index(prompt, "'"), strings.LastIndex(prompt, "'")
+	if start < 0 || end <= start {
+		return "", false
+	}
+	u, err := url.Parse(prompt[start+1 : end])
+	if err != nil || u.Scheme != "https" || u.Host != "github.com" {
+		return "", false
+	}
+
+	if strings.HasPrefix(prompt, "Username") {
+		return "x-access-token", true
+	} else if strings.HasPrefix(prompt, "Password") {
+		return token, true
+	}
+	return "", false
+}
+
+// RedactStderr replaces os.Stderr, where the logs are written, with a pipe
+// that masks the secrets before writing to the actual stderr.
+func RedactStderr(secrets func() []string) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	stderr := os.Stderr
+	os.Stderr = w
+	go redactLines(r, stderr, secrets)
+	return nil
+}
+
+func redactLines(r io.Reader, w io.Writer, secrets func() []string) {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			io.WriteString(w, MaskSecrets(line, secrets()))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAskpassAnswer(t *testing.T) {
+	answer, ok := askpassAnswer("Username for 'https://github.com': ", "token")
+	assert.True(t, ok)
+	assert.Equal(t, "x-access-token", answer)
+	answer, ok = askpassAnswer("Password for 'https://x-access-token@github.com': ", "token")
+	assert.True(t, ok)
+	assert.Equal(t, "token", answer)
+
+	// Submodules hosted elsewhere never get the token
+	for _, prompt := range []string{
+		"Password for 'https://x-access-token@evil.example.com': ",
+		"Password for 'https://github.com.evil.example.com': ",
+		"Password for 'http://x-access-token@github.com': ",
+		"Password for 'https://github.com:8443': ",
+		"Enter passphrase for key '/root/.ssh/id_rsa': ",
+		"Password: ",
+	} {
+		_, ok = askpassAnswer(prompt, "token")
+		assert.False(t, ok, prompt)
+	}
+}
@@ -1,134 +1,555 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/glog"
 )
 
+var (
+	MaxLineLength int
+	CloneDepth    int
+	CloneTags     bool
+)
+
+func init() {
+	flag.IntVar(&MaxLineLength, "max-line-length", 64*1024, "Lines of build output longer than this many bytes are split")
+	flag.IntVar(&CloneDepth, "clone-depth", 1, "The depth of the history fetched when cloning, 0 for the full history. Ignored with -mirror-dir")
+	flag.BoolVar(&CloneTags, "clone-tags", false, "Whether to fetch the tags when cloning, use with -clone-depth 0 for `git describe`. Ignored with -mirror-dir")
+}
+
 type Runner struct {
-	clonedir string
+	clonedir  string
+	eventpath string
+	home      string
+	env       []string
+	targetenv []string
+	mirrors   *mirrorCache
+	sshkey    string
+	token     string
+	release   func()
+	tty       *ttySize
+	timeout   time.Duration
+}
+
+// ttySize is the size of the pseudo-terminal of a target.
+type ttySize struct {
+	columns int
+	rows    int
 }
 
-func NewRunner() Runner {
-	runner := Runner{}
+func NewRunner() *Runner {
+	runner := &Runner{}
 	runner.clonedir = getCloneDir()
+	runner.eventpath = runner.clonedir + "-event.json"
+	runner.home = runner.clonedir + "-home"
 	return runner
 }
 
-func (r Runner) CloneRepo(cloneURL string, ref string) error {
-	glog.Infof("Cloning from %s into %s", ref, r.clonedir)
-	err := exec.Command("git", "clone", cloneURL, r.clonedir, "--depth", "1").Run()
+// SetJob exports the job information to every command the runner runs and
+// writes the raw webhook payload to the file in JARVIS_EVENT_PATH. The
+// commands get a HOME of their own, so that concurrent jobs never share
+// what the targets keep there, such as the caches under ~/.
+func (r *Runner) SetJob(job *Job) error {
+	err := ioutil.WriteFile(r.eventpath, job.Payload, 0600)
 	if err != nil {
-		return fmt.Errorf("Failed to clone directory %s into %s: %v", cloneURL, r.clonedir, err)
+		return fmt.Errorf("Failed to write event payload to %s: %v", r.eventpath, err)
 	}
+	err = os.MkdirAll(r.home, 0700)
+	if err != nil {
+		return fmt.Errorf("Failed to create home %s: %v", r.home, err)
+	}
+	r.env = append(job.Env(), "JARVIS_EVENT_PATH="+r.eventpath, "HOME="+r.home)
+	return nil
+}
+
+// SetTarget exports the name of the target about to run, along with the
+// environment specific to that target. The terminal and the timeout of the
+// previous target are reset.
+func (r *Runner) SetTarget(target string, env ...string) {
+	r.targetenv = append([]string{"JARVIS_TARGET=" + target}, env...)
+	r.tty = nil
+	r.timeout = 0
+}
 
-	// Fetch the ref
-	cmd := exec.Command("git", "fetch", "origin", ref, "--depth", "1")
+// UseTTY makes the watched commands run under a pseudo-terminal of the
+// size, for the tools that only color their output or show their progress
+// on a terminal. Their stdout and stderr are then merged.
+func (r *Runner) UseTTY(columns int, rows int) {
+	r.tty = &ttySize{columns, rows}
+}
+
+// SetTimeout kills the watched commands, and their children, once they ran
+// for longer than the timeout. Zero disables it.
+func (r *Runner) SetTimeout(timeout time.Duration) {
+	r.timeout = timeout
+}
+
+// UseMirrors makes the runner clone from the local mirrors of the
+// repositories instead of cloning from GitHub every time.
+func (r *Runner) UseMirrors(mirrors *mirrorCache) {
+	r.mirrors = mirrors
+}
+
+// UseToken makes git authenticate to GitHub with the token. The token is
+// never exposed to the targets.
+func (r *Runner) UseToken(token string) {
+	r.token = token
+}
+
+// UseSSHKey makes git authenticate with the SSH key. The key is never
+// exposed to the targets.
+func (r *Runner) UseSSHKey(keypath string) {
+	r.sshkey = keypath
+}
+
+// UseWorkspace makes the runner build in a persistent workspace instead of a
+// fresh clone. The release function is called instead of removing the
+// workspace on cleanup.
+func (r *Runner) UseWorkspace(dir string, release func()) {
+	r.clonedir = dir
+	r.release = release
+}
+
+func (r *Runner) command(program string, args ...string) *exec.Cmd {
+	cmd := exec.Command(program, args...)
 	cmd.Dir = r.clonedir
+	cmd.Env = append(append(os.Environ(), r.env...), r.targetenv...)
+	if program == "git" {
+		cmd.Env = append(cmd.Env, r.gitEnv()...)
+	}
+	return cmd
+}
+
+func (r *Runner) gitEnv() []string {
+	env := AskpassEnv(r.token)
+	if r.sshkey != "" {
+		env = append(env, "GIT_SSH_COMMAND="+SSHCommand(r.sshkey))
+	}
+	return env
+}
+
+// CloneRepo fetches the commit sha, which the ref pointed to, from the
+// repository at cloneURL. The commit is checked out by Checkout.
+func (r *Runner) CloneRepo(cloneURL string, ref string, sha string) error {
+	if r.release != nil {
+		if _, err := os.Stat(filepath.Join(r.clonedir, ".git")); err == nil {
+			return r.updateWorkspace(cloneURL, ref, sha)
+		}
+		os.RemoveAll(r.clonedir)
+	}
+	if r.mirrors != nil {
+		return r.cloneFromMirror(cloneURL, ref, sha)
+	}
+
+	glog.Infof("Cloning %s from %s into %s", sha, ref, r.clonedir)
+	cmd := r.command("git", "init", "--quiet", r.clonedir)
+	cmd.Dir = ""
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %s: %v", r.clonedir, err)
+	}
+
+	cmd = r.command("git", "remote", "add", "origin", cloneURL)
 	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Failed to set origin: %v", err)
+	}
+	return r.fetchCommit(ref, sha)
+}
+
+// fetchCommit fetches the exact commit from origin, falling back to the ref
+// for servers that do not allow fetching commits by sha.
+func (r *Runner) fetchCommit(ref string, sha string) error {
+	err := r.fetch(sha)
+	if err == nil {
+		return nil
+	}
+	glog.Warningf("Failed to fetch %s directly, fetching %s: %v", sha, ref, err)
+	err = r.fetch(ref)
 	if err != nil {
 		return fmt.Errorf("Failed to fetch ref %s: %v", ref, err)
 	}
 
-	// Checkout the fetched head
-	cmd = exec.Command("git", "checkout", "FETCH_HEAD")
-	cmd.Dir = r.clonedir
+	// The ref may have moved since the push, look further into its history
+	_, serr := os.Stat(filepath.Join(r.clonedir, ".git", "shallow"))
+	if !r.hasCommit(sha) && serr == nil {
+		cmd := r.command("git", "fetch", "--quiet", "--unshallow", "origin", ref)
+		err = cmd.Run()
+		if err != nil {
+			return fmt.Errorf("Failed to fetch the history of %s: %v", ref, err)
+		}
+	}
+	if !r.hasCommit(sha) {
+		return fmt.Errorf("Commit %s is not reachable from %s", sha, ref)
+	}
+	return nil
+}
+
+// fetch fetches the refspec from origin according to the clone flags.
+func (r *Runner) fetch(refspec string) error {
+	args := []string{"fetch", "--quiet"}
+	if CloneDepth > 0 {
+		args = append(args, "--depth", fmt.Sprintf("%d", CloneDepth))
+	}
+	if CloneTags {
+		args = append(args, "--tags")
+	} else {
+		args = append(args, "--no-tags")
+	}
+	args = append(args, "origin", refspec)
+	return r.command("git", args...).Run()
+}
+
+func (r *Runner) hasCommit(sha string) bool {
+	return r.command("git", "cat-file", "-e", sha+"^{commit}").Run() == nil
+}
+
+// cloneFromMirror updates the mirror of the repository and clones it. The
+// clone hardlinks the objects of the mirror rather than borrowing them, so
+// that it is near-instant and pruning the mirror never breaks a clone,
+// persistent ones included.
+func (r *Runner) cloneFromMirror(cloneURL string, ref string, sha string) error {
+	mirror, err := r.mirrors.Path(cloneURL)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := r.mirrors.Lock(mirror)
+	if err != nil {
+		return fmt.Errorf("Failed to lock mirror %s: %v", mirror, err)
+	}
+	defer unlock()
+
+	err = r.mirrors.Update(mirror, cloneURL, ref, sha, r.gitEnv())
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("Cloning %s from %s into %s using mirror %s", sha, ref, r.clonedir, mirror)
+	cmd := r.command("git", "clone", "--local", "--no-checkout", "--quiet", mirror, r.clonedir)
+	cmd.Dir = ""
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Failed to clone mirror %s into %s: %v", mirror, r.clonedir, err)
+	}
+
+	// Point origin back to GitHub for the targets
+	cmd = r.command("git", "remote", "set-url", "origin", cloneURL)
 	err = cmd.Run()
 	if err != nil {
-		return fmt.Errorf("Failed to checkout FETCH_HEAD: %v", err)
+		return fmt.Errorf("Failed to set origin: %v", err)
 	}
 	return nil
 }
 
-func (r Runner) Checkout(head string) error {
+// updateWorkspace brings the persistent workspace to the commit sha and
+// cleans it according to -workspace-clean.
+func (r *Runner) updateWorkspace(cloneURL string, ref string, sha string) error {
+	glog.Infof("Updating workspace %s to %s", r.clonedir, sha)
+	cmd := r.command("git", "remote", "set-url", "origin", cloneURL)
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Failed to set origin: %v", err)
+	}
+
+	if r.mirrors == nil {
+		err = r.fetchCommit(ref, sha)
+	} else {
+		err = r.fetchFromMirror(cloneURL, ref, sha)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Throw away what the previous job changed
+	cmd = r.command("git", "reset", "--quiet", "--hard")
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Failed to reset workspace: %v", err)
+	}
+
+	args := []string{}
+	switch WorkspaceClean {
+	case WORKSPACE_CLEAN_NONE:
+		return nil
+	case WORKSPACE_CLEAN_ALL:
+		args = []string{"clean", "-ffdxq"}
+	default:
+		args = []string{"clean", "-ffdq"}
+	}
+	cmd = r.command("git", args...)
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Failed to clean workspace: %v", err)
+	}
+	return nil
+}
+
+// fetchFromMirror updates the mirror of the repository and fetches the
+// commit from it.
+func (r *Runner) fetchFromMirror(cloneURL string, ref string, sha string) error {
+	mirror, err := r.mirrors.Path(cloneURL)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := r.mirrors.Lock(mirror)
+	if err != nil {
+		return fmt.Errorf("Failed to lock mirror %s: %v", mirror, err)
+	}
+	defer unlock()
+
+	err = r.mirrors.Update(mirror, cloneURL, ref, sha, r.gitEnv())
+	if err != nil {
+		return err
+	}
+
+	cmd := r.command("git", "fetch", "--quiet", "--no-tags", mirror, sha)
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Failed to fetch %s from mirror: %v", sha, err)
+	}
+	return nil
+}
+
+// Checkout checks out the exact commit and makes sure it is the one in the
+// working tree.
+func (r *Runner) Checkout(head string) error {
 	glog.Infof("Checking out head %s", head)
-	cmd := exec.Command("git", "checkout", head)
-	cmd.Dir = r.clonedir
+	cmd := r.command("git", "checkout", "--quiet", "--force", "--detach", head)
+	cmd.Env = append(cmd.Env, "GIT_LFS_SKIP_SMUDGE=1")
 	err := cmd.Run()
 	if err != nil {
 		return fmt.Errorf("Failed to checkout head %s in %s: %v", head, r.clonedir, err)
 	}
+
+	out, err := r.command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return fmt.Errorf("Failed to read HEAD in %s: %v", r.clonedir, err)
+	} else if strings.TrimSpace(string(out)) != head {
+		return fmt.Errorf("Checked out %s instead of %s", strings.TrimSpace(string(out)), head)
+	}
+	return nil
+}
+
+// UpdateSubmodules recursively initializes the submodules, rewriting the
+// SSH URLs of GitHub to HTTPS so that they are cloned with the same
+// credentials as the repository.
+func (r *Runner) UpdateSubmodules() error {
+	args := []string{"-c", "url.https://github.com/.insteadOf=git@github.com:"}
+	args = append(args, "submodule", "update", "--init", "--recursive", "--quiet")
+	out, err := r.command("git", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to update submodules: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// PullLFS fetches and checks out the Git LFS objects of the checked out commit.
+func (r *Runner) PullLFS() error {
+	out, err := r.command("git", "lfs", "pull").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to pull LFS objects: %v: %s", err, strings.TrimSpace(string(out)))
+	}
 	return nil
 }
 
-func (r Runner) Run(program string, args ...string) ([]byte, error) {
+func (r *Runner) Run(program string, args ...string) ([]byte, error) {
 	glog.Infof("Running `%s %v`", program, args)
-	cmd := exec.Command(program, args...)
-	cmd.Dir = r.clonedir
+	cmd := r.command(program, args...)
 	return cmd.CombinedOutput()
 }
 
+const (
+	STREAM_STDOUT = "stdout"
+	STREAM_STDERR = "stderr"
+
+	TTY_TERM = "xterm-256color"
+
+	// WAIT_DELAY is how long the output of a command that exited, or was
+	// killed, is still read when children it left behind keep it open.
+	WAIT_DELAY = 10 * time.Second
+)
+
 type item struct {
 	output string
+	stream string
 	err    error
 }
 
-func (r Runner) Watch(program string, args ...string) (chan item, error) {
+// lineWriter splits whatever is written to it into lines and forwards them,
+// tagged with their stream, onto the item channel. Writes from stdout and
+// stderr are serialized through the same lock so that their relative order
+// is kept.
+type lineWriter struct {
+	stream string
+	buf    []byte
+	lock   *sync.Mutex
+	out    chan item
+
+	// overwrite keeps only what follows the last carriage return of a line,
+	// as a terminal redrawing a progress bar would show.
+	overwrite bool
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+
+	// Split overly long lines instead of buffering them forever
+	for MaxLineLength > 0 && len(w.buf) >= MaxLineLength {
+		w.emit(w.buf[:MaxLineLength])
+		w.buf = w.buf[MaxLineLength:]
+	}
+	return len(p), nil
+}
+
+// Flush sends the remaining partial line, if any.
+func (w *lineWriter) Flush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.buf) > 0 {
+		w.emit(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *lineWriter) emit(line []byte) {
+	text := strings.TrimSuffix(string(line), "\r")
+	if i := strings.LastIndexByte(text, '\r'); w.overwrite && i >= 0 {
+		text = text[i+1:]
+	}
+	w.out <- item{text, w.stream, nil}
+}
+
+func (r *Runner) Watch(program string, args ...string) (chan item, error) {
 	glog.Infof("Watching `%s %v`", program, args)
 
 	out := make(chan item, 0)
-	cmd := exec.Command(program, args...)
-	cmd.Dir = r.clonedir
+	cmd := r.command(program, args...)
 
-	cmdReader, err := cmd.StdoutPipe()
+	lock := &sync.Mutex{}
+	stdout := &lineWriter{stream: STREAM_STDOUT, lock: lock, out: out}
+	stderr := &lineWriter{stream: STREAM_STDERR, lock: lock, out: out}
+
+	var tty *os.File
+	var err error
+	if r.tty != nil {
+		cmd.Env = append(cmd.Env, "TERM="+TTY_TERM)
+		stdout.overwrite = true
+		tty, err = startPTY(cmd, r.tty.columns, r.tty.rows)
+	} else {
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		if r.timeout > 0 {
+			setProcessGroup(cmd)
+			cmd.WaitDelay = WAIT_DELAY
+		}
+		err = cmd.Start()
+	}
 	if err != nil {
 		close(out)
 		return out, err
 	}
 
-	err = cmd.Start()
-	if err != nil {
-		close(out)
-		return out, err
+	// Read the terminal until the command and its children close it
+	copied := make(chan struct{})
+	if tty != nil {
+		go func() {
+			io.Copy(stdout, tty)
+			close(copied)
+		}()
+	} else {
+		close(copied)
+	}
+
+	// Kill the command once it runs over its timeout
+	timedout := int32(0)
+	var timer *time.Timer
+	if r.timeout > 0 {
+		timer = time.AfterFunc(r.timeout, func() {
+			atomic.StoreInt32(&timedout, 1)
+			killProcessGroup(cmd)
+		})
 	}
 
-	wg := &sync.WaitGroup{}
-	wg.Add(2)
 	go func() {
-		defer wg.Done()
-		scanner := bufio.NewScanner(cmdReader)
-		for scanner.Scan() {
-			if err := scanner.Err(); err != nil {
-				out <- item{"", err}
-				return
+		err := cmd.Wait()
+		if timer != nil {
+			timer.Stop()
+		}
+		if tty != nil {
+			select {
+			case <-copied:
+			case <-time.After(WAIT_DELAY):
 			}
-			out <- item{scanner.Text(), nil}
+			tty.Close()
+			<-copied
+		}
+		stdout.Flush()
+		stderr.Flush()
+		if atomic.LoadInt32(&timedout) == 1 {
+			err = fmt.Errorf("Timed out after %v", r.timeout)
 		}
-	}()
-
-	go func() {
-		defer wg.Done()
-		err = cmd.Wait()
 		if err != nil {
-			out <- item{"", err}
+			out <- item{"", "", err}
 		}
-	}()
-
-	go func() {
-		wg.Wait()
 		close(out)
 	}()
 
 	return out, nil
 }
 
-func (r Runner) WatchFn(fn func(string) error, program string, args ...string) error {
+// WatchFn calls fn with every line the command writes, regardless of the stream.
+func (r *Runner) WatchFn(fn func(string) error, program string, args ...string) error {
+	return r.WatchStreamFn(func(stream, line string) error {
+		return fn(line)
+	}, program, args...)
+}
+
+// WatchStreamFn calls fn with every line the command writes along with the
+// stream it was written to.
+func (r *Runner) WatchStreamFn(fn func(stream, line string) error, program string, args ...string) error {
 	items, err := r.Watch(program, args...)
 	if err != nil {
 		return err
 	}
 
+	// Drain the remaining items so the command never blocks on its output
+	defer func() {
+		go func() {
+			for range items {
+			}
+		}()
+	}()
+
 	for item := range items {
 		if item.err != nil {
 			return item.err
 		}
 
-		err = fn(item.output)
+		err = fn(item.stream, item.output)
 		if err != nil {
 			return err
 		}
@@ -137,9 +558,38 @@ func (r Runner) WatchFn(fn func(string) error, program string, args ...string) e
 	return nil
 }
 
-func (r Runner) Cleanup() {
-	err := os.RemoveAll(r.clonedir)
+func (r *Runner) Cleanup() {
+	// Persistent workspaces are only released
+	if r.release != nil {
+		r.release()
+	} else {
+		err := removeAll(r.clonedir)
+		if err != nil {
+			glog.Errorf("Failed to cleanup runner %s: %v", r.clonedir, err)
+		}
+	}
+	err := removeAll(r.home)
 	if err != nil {
-		glog.Errorf("Failed to cleanup runner %v: %v", r, err)
+		glog.Errorf("Failed to remove home %s: %v", r.home, err)
 	}
+
+	err = os.Remove(r.eventpath)
+	if err != nil && !os.IsNotExist(err) {
+		glog.Errorf("Failed to remove event payload %s: %v", r.eventpath, err)
+	}
+}
+
+// removeAll removes the directory, including the read-only directories that
+// tools such as go leave in their caches.
+func removeAll(dir string) error {
+	if os.RemoveAll(dir) == nil {
+		return nil
+	}
+	filepath.Walk(dir, func(filename string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() {
+			os.Chmod(filename, 0700)
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
 }
@@ -1,7 +1,15 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -20,3 +28,224 @@ func TestStreamingOutput(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotEqual(t, "", lines)
 }
+
+func TestStreamingStderrAndLongLines(t *testing.T) {
+	runner := NewRunner()
+	runner.clonedir = "/"
+
+	lines := []string{}
+	streams := []string{}
+	fn := func(stream, line string) error {
+		lines = append(lines, line)
+		streams = append(streams, stream)
+		return nil
+	}
+
+	script := "echo out; sleep 0.1; echo err 1>&2; sleep 0.1; head -c 200000 /dev/zero | tr '\\0' a; echo; printf partial"
+	err := runner.WatchStreamFn(fn, "sh", "-c", script)
+	assert.Nil(t, err)
+	assert.Equal(t, "out", lines[0])
+	assert.Equal(t, STREAM_STDOUT, streams[0])
+	assert.Equal(t, "err", lines[1])
+	assert.Equal(t, STREAM_STDERR, streams[1])
+
+	long := 0
+	for _, line := range lines[2 : len(lines)-1] {
+		long += len(line)
+	}
+	assert.Equal(t, 200000, long)
+	assert.Equal(t, "partial", lines[len(lines)-1])
+}
+
+func TestJobEnvironment(t *testing.T) {
+	runner := NewRunner()
+	runner.clonedir = "/"
+	defer os.Remove(runner.eventpath)
+
+	job := NewJob(TRIGGER_PUSH)
+	job.Repo, job.Ref, job.Commit = "owner/repo", "refs/heads/feature/x", "abc"
+	job.OutputURL = "http://jarvis/outputs/" + job.ID
+	job.Payload = []byte(`{"ref":"refs/heads/feature/x"}`)
+	assert.Nil(t, runner.SetJob(job))
+	runner.SetTarget("jarvis-ci-test", "TOKEN=secret")
+
+	out, err := runner.Run("sh", "-c", "env; cat $JARVIS_EVENT_PATH")
+	assert.Nil(t, err)
+	for _, variable := range []string{
+		"CI=true",
+		"JARVIS=true",
+		"JARVIS_JOB_ID=" + job.ID,
+		"JARVIS_REPO=owner/repo",
+		"JARVIS_REF=refs/heads/feature/x",
+		"JARVIS_BRANCH=feature/x",
+		"JARVIS_COMMIT=abc",
+		"JARVIS_OUTPUT_URL=http://jarvis/outputs/" + job.ID,
+		"JARVIS_EVENT_PATH=" + runner.eventpath,
+		"JARVIS_TARGET=jarvis-ci-test",
+		"TOKEN=secret",
+	} {
+		assert.Contains(t, string(out), variable+"\n")
+	}
+	assert.NotContains(t, string(out), "JARVIS_PR_NUMBER")
+	assert.True(t, strings.HasSuffix(string(out), `{"ref":"refs/heads/feature/x"}`))
+
+	job.PRNumber = 42
+	assert.Nil(t, runner.SetJob(job))
+	out, err = runner.Run("sh", "-c", "env")
+	assert.Nil(t, err)
+	assert.Contains(t, string(out), "JARVIS_PR_NUMBER=42\n")
+}
+
+func TestCloneExactCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clone")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Create the upstream repository, its ref having moved past the commit
+	upstream := filepath.Join(dir, "owner", "repo")
+	script := "git init -q -b master %[1]s && cd %[1]s && " +
+		"echo first > file && git add file && git -c user.name=t -c user.email=t@t commit -q -m first && " +
+		"git rev-parse HEAD > ../sha && " +
+		"echo second > file && git -c user.name=t -c user.email=t@t commit -q -am second"
+	assert.Nil(t, exec.Command("sh", "-c", fmt.Sprintf(script, upstream)).Run())
+	sha, err := ioutil.ReadFile(filepath.Join(dir, "owner", "sha"))
+	assert.Nil(t, err)
+	head := strings.TrimSpace(string(sha))
+
+	mirrors := NewMirrorCache(filepath.Join(dir, "mirrors"))
+	for _, m := range []*mirrorCache{nil, mirrors, mirrors} {
+		runner := NewRunner()
+		runner.UseMirrors(m)
+		err = runner.CloneRepo("file://"+upstream, "refs/heads/master", head)
+		assert.Nil(t, err)
+		err = runner.Checkout(head)
+		assert.Nil(t, err)
+
+		content, err := ioutil.ReadFile(filepath.Join(runner.clonedir, "file"))
+		assert.Nil(t, err)
+		assert.Equal(t, "first\n", string(content))
+
+		// The clone does not depend on the objects of the mirror, it links them
+		_, err = os.Stat(filepath.Join(runner.clonedir, ".git", "objects", "info", "alternates"))
+		assert.True(t, os.IsNotExist(err))
+		linked := false
+		filepath.Walk(filepath.Join(runner.clonedir, ".git", "objects"), func(path string, fi os.FileInfo, err error) error {
+			if err == nil && fi.Mode().IsRegular() && fi.Sys().(*syscall.Stat_t).Nlink > 1 {
+				linked = true
+			}
+			return nil
+		})
+		assert.Equal(t, m != nil, linked)
+		runner.Cleanup()
+	}
+}
+
+func TestCloneSubmodules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "submodules")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Git only clones local submodules when allowed to
+	os.Setenv("GIT_CONFIG_COUNT", "1")
+	os.Setenv("GIT_CONFIG_KEY_0", "protocol.file.allow")
+	os.Setenv("GIT_CONFIG_VALUE_0", "always")
+	defer os.Unsetenv("GIT_CONFIG_COUNT")
+
+	// The repository includes lib, which itself includes nested
+	script := "commit() { git -c user.name=t -c user.email=t@t commit -q -m \"$1\"; } && " +
+		"for repo in nested lib repo; do git init -q -b master %[1]s/$repo; done && " +
+		"cd %[1]s/nested && echo nested > file && git add file && commit nested && " +
+		"cd %[1]s/lib && echo lib > file && git add file && git submodule -q add file://%[1]s/nested nested && commit lib && " +
+		"cd %[1]s/repo && git submodule -q add file://%[1]s/lib lib && commit repo && git rev-parse HEAD"
+	out, err := exec.Command("sh", "-c", fmt.Sprintf(script, dir)).CombinedOutput()
+	assert.Nil(t, err, string(out))
+	head := strings.TrimSpace(string(out))
+
+	runner := NewRunner()
+	defer runner.Cleanup()
+	assert.Nil(t, runner.CloneRepo("file://"+dir+"/repo", "refs/heads/master", head))
+	assert.Nil(t, runner.Checkout(head))
+	assert.Nil(t, runner.UpdateSubmodules())
+
+	content, err := ioutil.ReadFile(filepath.Join(runner.clonedir, "lib", "nested", "file"))
+	assert.Nil(t, err)
+	assert.Equal(t, "nested\n", string(content))
+
+	if exec.Command("git", "lfs", "version").Run() != nil {
+		t.Skip("git lfs is not installed")
+	}
+	assert.Nil(t, runner.PullLFS())
+}
+
+func TestPersistentWorkspace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "owner", "repo")
+	script := "git init -q -b master %[1]s && cd %[1]s && echo build > .gitignore && " +
+		"git add .gitignore && git -c user.name=t -c user.email=t@t commit -q -m init && git rev-parse HEAD"
+	out, err := exec.Command("sh", "-c", fmt.Sprintf(script, upstream)).Output()
+	assert.Nil(t, err)
+	head := strings.TrimSpace(string(out))
+
+	pool := NewWorkspacePool(filepath.Join(dir, "workspaces"), 1<<30, 1)
+	for i := 0; i < 2; i++ {
+		workspace, release, err := pool.Acquire("owner/repo", "master")
+		assert.Nil(t, err)
+
+		runner := NewRunner()
+		runner.UseWorkspace(workspace, release)
+		assert.Nil(t, runner.CloneRepo("file://"+upstream, "refs/heads/master", head))
+		assert.Nil(t, runner.Checkout(head))
+
+		// Ignored files survive between builds, untracked ones do not
+		_, err = os.Stat(filepath.Join(workspace, "build"))
+		assert.Equal(t, i == 1, err == nil)
+		_, err = os.Stat(filepath.Join(workspace, "untracked"))
+		assert.True(t, os.IsNotExist(err))
+
+		ioutil.WriteFile(filepath.Join(workspace, "build"), []byte("cached"), 0644)
+		ioutil.WriteFile(filepath.Join(workspace, "untracked"), []byte("dirty"), 0644)
+		runner.Cleanup()
+	}
+}
+
+func TestWatchUnderTTY(t *testing.T) {
+	runner := NewRunner()
+	runner.clonedir = "/"
+	runner.SetTarget("test")
+	runner.UseTTY(100, 30)
+
+	lines := []string{}
+	streams := []string{}
+	fn := func(stream, line string) error {
+		lines = append(lines, line)
+		streams = append(streams, stream)
+		return nil
+	}
+
+	script := "test -t 1 && echo tty; stty size; echo err 1>&2; printf '10%%\\r100%%\\n'; printf partial"
+	err := runner.WatchStreamFn(fn, "sh", "-c", script)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"tty", "30 100", "err", "100%", "partial"}, lines)
+	assert.Equal(t, STREAM_STDOUT, streams[2])
+}
+
+func TestWatchTimeout(t *testing.T) {
+	for _, tty := range []bool{false, true} {
+		runner := NewRunner()
+		runner.clonedir = "/"
+		runner.SetTarget("test")
+		if tty {
+			runner.UseTTY(80, 24)
+		}
+		runner.SetTimeout(200 * time.Millisecond)
+
+		start := time.Now()
+		err := runner.WatchFn(func(string) error { return nil }, "sh", "-c", "echo start; sleep 5 & sleep 5")
+		assert.NotNil(t, err)
+		assert.Contains(t, fmt.Sprint(err), "Timed out after 200ms")
+		assert.True(t, time.Since(start) < 4*time.Second, "tty: %v", tty)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	S3_UNSIGNED_PAYLOAD = "UNSIGNED-PAYLOAD"
+	S3_TIME_FORMAT      = "20060102T150405Z"
+)
+
+// s3Client is a minimal client of the S3 API, signing requests with AWS
+// Signature Version 4. Buckets are addressed path-style, as MinIO and most
+// S3-compatible stores expect.
+type s3Client struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func NewS3Client(endpoint string, bucket string, region string, accessKey string, secretKey string) (*s3Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("Invalid S3 endpoint: %s", endpoint)
+	}
+	client := &s3Client{}
+	client.endpoint = u
+	client.bucket = bucket
+	client.region = region
+	client.accessKey = accessKey
+	client.secretKey = secretKey
+	client.client = &http.Client{}
+	return client, nil
+}
+
+func (c *s3Client) objectURI(key string) string {
+	return c.endpoint.Path + "/" + s3Escape(c.bucket) + "/" + s3Escape(key)
+}
+
+// PutObject uploads the object, of the given size, under the key.
+func (c *s3Client) PutObject(key string, body io.Reader, size int64, contentType string) error {
+	uri := c.objectURI(key)
+	req, err := http.NewRequest("PUT", c.endpoint.Scheme+"://"+c.endpoint.Host+uri, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	c.sign(req, uri, time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Failed to upload %s, bad status code %d: %s", key, resp.StatusCode, message)
+	}
+	return nil
+}
+
+// GetObject downloads the object, the caller closing the body of the response.
+func (c *s3Client) GetObject(key string) (*http.Response, error) {
+	uri := c.objectURI(key)
+	req, err := http.NewRequest("GET", c.endpoint.Scheme+"://"+c.endpoint.Host+uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, uri, time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Failed to download %s, bad status code %d", key, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// PresignGet returns a URL downloading the object without credentials
+// until it expires.
+func (c *s3Client) PresignGet(key string, expires time.Duration) string {
+	uri := c.objectURI(key)
+	return c.presign("GET", c.endpoint.Host, uri, expires, time.Now())
+}
+
+func (c *s3Client) presign(method string, host string, uri string, expires time.Duration, now time.Time) string {
+	now = now.UTC()
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", c.accessKey+"/"+c.scope(now))
+	query.Set("X-Amz-Date", now.Format(S3_TIME_FORMAT))
+	query.Set("X-Amz-Expires", fmt.Sprintf("%d", int(expires.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalQuery := s3CanonicalQuery(query)
+	request := strings.Join([]string{method, uri, canonicalQuery, "host:" + host + "\n", "host", S3_UNSIGNED_PAYLOAD}, "\n")
+	signature := c.signature(request, now)
+	return c.endpoint.Scheme + "://" + host + uri + "?" + canonicalQuery + "&X-Amz-Signature=" + signature
+}
+
+// sign adds the Authorization header of the request, leaving its payload
+// unsigned so that large files can be streamed.
+func (c *s3Client) sign(req *http.Request, uri string, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(S3_TIME_FORMAT))
+	req.Header.Set("X-Amz-Content-Sha256", S3_UNSIGNED_PAYLOAD)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+	request := strings.Join([]string{req.Method, uri, s3CanonicalQuery(req.URL.Query()), canonicalHeaders,
+		signedHeaders, S3_UNSIGNED_PAYLOAD}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, c.scope(now), signedHeaders, c.signature(request, now)))
+}
+
+func (c *s3Client) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + c.region + "/s3/aws4_request"
+}
+
+func (c *s3Client) signature(request string, now time.Time) string {
+	hash := sha256.Sum256([]byte(request))
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", now.Format(S3_TIME_FORMAT), c.scope(now), hex.EncodeToString(hash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), now.Format("20060102"))
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := []string{}
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := []string{}
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3EscapeComponent(key)+"="+s3EscapeComponent(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape escapes a key the way S3 does for canonical requests, keeping
+// the slashes.
+func s3Escape(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = s3EscapeComponent(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+func s3EscapeComponent(s string) string {
+	escaped := ""
+	for _, b := range []byte(s) {
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') || strings.IndexByte("-_.~", b) >= 0 {
+			escaped += string(b)
+		} else {
+			escaped += fmt.Sprintf("%%%02X", b)
+		}
+	}
+	return escaped
+}
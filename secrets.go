@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+const (
+	SECRETS_INDEX = "secrets.json"
+	SECRET_MASK   = "***"
+
+	// The forms of secrets shorter than this, such as a secure value of true
+	// or the braces of a JSON document, are too common to be masked.
+	SECRET_MIN_LENGTH = 8
+)
+
+var (
+	SecretsDir string
+)
+
+func init() {
+	flag.StringVar(&SecretsDir, "secrets-dir", "/jarvis-ci/secrets", "The directory holding the secrets and their secrets.json index")
+}
+
+type Secret struct {
+	Name  string
+	Value string
+}
+
+type SecretStore interface {
+	// Secrets returns the secrets that should be exported to the target of the job.
+	Secrets(job *Job, target string) ([]Secret, error)
+
+	// Values returns every secret value known to the store so that they can be masked.
+	Values() []string
+}
+
+// secretEntry is one entry of the secrets.json index. The value of the
+// secret is read from File, relative to the secrets directory. Repos,
+// Branches and Targets are lists of patterns as understood by path.Match;
+// an empty list matches nothing for Repos and everything otherwise.
+type secretEntry struct {
+	Name     string   `json:"name"`
+	File     string   `json:"file"`
+	Repos    []string `json:"repos"`
+	Branches []string `json:"branches"`
+	Targets  []string `json:"targets"`
+}
+
+type fileSecretStore struct {
+	dir     string
+	entries []secretEntry
+	values  map[string]string
+	lock    *sync.Mutex
+}
+
+var _ SecretStore = &fileSecretStore{}
+
+func DefaultSecretStore() *fileSecretStore {
+	return NewFileSecretStore(SecretsDir)
+}
+
+func NewFileSecretStore(dir string) *fileSecretStore {
+	store := &fileSecretStore{}
+	store.dir = dir
+	store.values = map[string]string{}
+	store.lock = &sync.Mutex{}
+	if err := store.load(); err != nil {
+		glog.Warningf("Failed to load secrets: %v", err)
+	}
+	return store
+}
+
+// load reads the index and every secret file again, so that secrets can be
+// changed without restarting the server.
+func (s *fileSecretStore) load() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	content, err := ioutil.ReadFile(filepath.Join(s.dir, SECRETS_INDEX))
+	if os.IsNotExist(err) {
+		s.entries, s.values = nil, map[string]string{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	entries := []secretEntry{}
+	err = json.Unmarshal(content, &entries)
+	if err != nil {
+		return fmt.Errorf("Failed to parse %s: %v", SECRETS_INDEX, err)
+	}
+
+	values := map[string]string{}
+	for _, entry := range entries {
+		if entry.Name == "" || entry.File == "" {
+			return fmt.Errorf("Secret entries need both a name and a file: %+v", entry)
+		}
+		value, err := ioutil.ReadFile(filepath.Join(s.dir, filepath.Clean("/"+entry.File)))
+		if err != nil {
+			return fmt.Errorf("Failed to read secret %s: %v", entry.Name, err)
+		}
+		values[entry.File] = strings.TrimRight(string(value), "\n")
+	}
+	s.entries, s.values = entries, values
+	return nil
+}
+
+func (s *fileSecretStore) Secrets(job *Job, target string) ([]Secret, error) {
+	// Secrets never leave the server for builds of forks
+	if job.Fork {
+		return nil, nil
+	}
+
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	secrets := []Secret{}
+	for _, entry := range s.entries {
+		if !matchAny(entry.Repos, job.Repo, false) {
+			continue
+		} else if !matchAny(entry.Branches, job.Branch(), true) {
+			continue
+		} else if !matchAny(entry.Targets, target, true) {
+			continue
+		}
+		secrets = append(secrets, Secret{entry.Name, s.values[entry.File]})
+	}
+	return secrets, nil
+}
+
+func (s *fileSecretStore) Values() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	values := []string{}
+	for _, value := range s.values {
+		values = append(values, value)
+	}
+	return values
+}
+
+func matchAny(patterns []string, name string, empty bool) bool {
+	if len(patterns) == 0 {
+		return empty
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// maskingOutputHandler replaces every secret value, and its base64 forms,
+// in the output before handing it to the underlying handler.
+type maskingOutputHandler struct {
+	OutputHandler
+	secrets func() []string
+}
+
+var _ OutputHandler = &maskingOutputHandler{}
+
+func NewMaskingOutputHandler(handler OutputHandler, secrets func() []string) *maskingOutputHandler {
+	return &maskingOutputHandler{handler, secrets}
+}
+
+func (h *maskingOutputHandler) AddOutput(jobid string, target string, stream string, text string) {
+	h.OutputHandler.AddOutput(jobid, target, stream, MaskSecrets(text, h.secrets()))
+}
+
+// MaskSecrets replaces the secrets found in the string with a mask.
+func MaskSecrets(s string, secrets []string) string {
+	for _, secret := range secrets {
+		for _, form := range secretForms(secret) {
+			s = strings.Replace(s, form, SECRET_MASK, -1)
+		}
+	}
+	return s
+}
+
+// secretForms returns the secret along with the forms it takes once base64
+// encoded, either alone or in the middle of a larger encoded string. The
+// output being masked a line at a time, every line of a multi-line secret,
+// such as a private key, is a form of its own. Forms shorter than
+// SECRET_MIN_LENGTH are left out.
+func secretForms(secret string) []string {
+	forms := []string{}
+	add := func(form string) {
+		if len(form) >= SECRET_MIN_LENGTH {
+			forms = append(forms, form)
+		}
+	}
+
+	add(secret)
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding} {
+		add(strings.TrimRight(encoding.EncodeToString([]byte(secret)), "="))
+
+		// The secret can start at any of 3 offsets within the encoded blocks,
+		// only keep the characters that do not depend on the surrounding bytes
+		for offset := 0; offset < 3; offset++ {
+			encoded := encoding.EncodeToString(append(make([]byte, offset), secret...))
+			start := (8*offset + 5) / 6
+			end := 8 * (offset + len(secret)) / 6
+			if end > start {
+				add(encoded[start:end])
+			}
+		}
+	}
+	if strings.Contains(secret, "\n") {
+		for _, line := range strings.Split(secret, "\n") {
+			add(strings.TrimSpace(line))
+		}
+	}
+	return forms
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	SQL_DRIVER_SQLITE   = "sqlite3"
+	SQL_DRIVER_POSTGRES = "postgres"
+)
+
+// sqlMigrations are applied in order, each exactly once. Never edit one
+// that was released, append a new one instead.
+var sqlMigrations = []string{
+	`CREATE TABLE jobs (
+		id TEXT PRIMARY KEY,
+		repo TEXT NOT NULL,
+		ref TEXT NOT NULL,
+		branch TEXT NOT NULL,
+		commit_sha TEXT NOT NULL,
+		trigger_name TEXT NOT NULL,
+		output_url TEXT NOT NULL,
+		pr_number INTEGER NOT NULL,
+		fork INTEGER NOT NULL,
+		state TEXT NOT NULL,
+		created TEXT NOT NULL,
+		started TEXT NOT NULL,
+		finished TEXT NOT NULL,
+		log_location TEXT NOT NULL
+	)`,
+	`CREATE INDEX jobs_by_branch ON jobs (repo, branch, state, created)`,
+	`CREATE TABLE targets (
+		job_id TEXT NOT NULL REFERENCES jobs (id),
+		position INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		state TEXT NOT NULL,
+		exit_code INTEGER NOT NULL,
+		started TEXT NOT NULL,
+		finished TEXT NOT NULL,
+		PRIMARY KEY (job_id, position)
+	)`,
+	`CREATE TABLE statuses (
+		job_id TEXT NOT NULL REFERENCES jobs (id),
+		position INTEGER NOT NULL,
+		target TEXT NOT NULL,
+		state TEXT NOT NULL,
+		created TEXT NOT NULL,
+		PRIMARY KEY (job_id, position)
+	)`,
+	`CREATE TABLE annotations (
+		job_id TEXT NOT NULL REFERENCES jobs (id),
+		position INTEGER NOT NULL,
+		target TEXT NOT NULL,
+		level TEXT NOT NULL,
+		file TEXT NOT NULL,
+		line INTEGER NOT NULL,
+		column_number INTEGER NOT NULL,
+		title TEXT NOT NULL,
+		message TEXT NOT NULL,
+		PRIMARY KEY (job_id, position)
+	)`,
+	`CREATE TABLE tests (
+		job_id TEXT NOT NULL REFERENCES jobs (id),
+		position INTEGER NOT NULL,
+		target TEXT NOT NULL,
+		suite TEXT NOT NULL,
+		name TEXT NOT NULL,
+		state TEXT NOT NULL,
+		duration INTEGER NOT NULL,
+		message TEXT NOT NULL,
+		PRIMARY KEY (job_id, position)
+	)`,
+}
+
+// sqlJobStore records the jobs in a SQL database, SQLite by default or
+// Postgres.
+type sqlJobStore struct {
+	db     *sql.DB
+	driver string
+	lock   *sync.Mutex
+}
+
+var _ JobStore = &sqlJobStore{}
+
+func NewSQLJobStore(driver string, source string) (*sqlJobStore, error) {
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open job database: %v", err)
+	}
+
+	store := &sqlJobStore{}
+	store.db = db
+	store.driver = driver
+	store.lock = &sync.Mutex{}
+	err = store.migrate()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to migrate job database: %v", err)
+	}
+	return store, nil
+}
+
+// migrate applies the migrations the database has not seen yet.
+func (s *sqlJobStore) migrate() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+
+	version := 0
+	err = s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqlMigrations); i++ {
+		glog.Infof("Applying job database migration %d", i+1)
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(sqlMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Migration %d: %v", i+1, err)
+		}
+		if _, err = tx.Exec(s.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebind turns the ? placeholders into the ones of the driver.
+func (s *sqlJobStore) rebind(query string) string {
+	if s.driver != SQL_DRIVER_POSTGRES {
+		return query
+	}
+	parts := strings.Split(query, "?")
+	for i := 1; i < len(parts); i++ {
+		parts[i] = fmt.Sprintf("$%d", i) + parts[i]
+	}
+	return strings.Join(parts, "")
+}
+
+func (s *sqlJobStore) Save(job *Job) error {
+	snapshot := job.Snapshot()
+	fork := 0
+	if snapshot.Fork {
+		fork = 1
+	}
+
+	// Jobs are saved from a single goroutine each, the lock only keeps SQLite
+	// from failing on concurrent writers
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(s.rebind(`INSERT INTO jobs (id, repo, ref, branch, commit_sha, trigger_name, output_url,
+		pr_number, fork, state, created, started, finished, log_location)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET state = excluded.state, started = excluded.started,
+		finished = excluded.finished, log_location = excluded.log_location`),
+		snapshot.ID, snapshot.Repo, snapshot.Ref, snapshot.Branch(), snapshot.Commit, snapshot.Trigger,
+		snapshot.OutputURL, snapshot.PRNumber, fork, snapshot.State, formatTime(snapshot.Created),
+		formatTime(snapshot.Started), formatTime(snapshot.Finished), snapshot.LogLocation)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Rewrite the targets, statuses, annotations and tests of the job
+	for _, table := range []string{"targets", "statuses", "annotations", "tests"} {
+		if _, err = tx.Exec(s.rebind(`DELETE FROM `+table+` WHERE job_id = ?`), snapshot.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for i, run := range snapshot.Targets {
+		_, err = tx.Exec(s.rebind(`INSERT INTO targets (job_id, position, name, state, exit_code, started, finished)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`),
+			snapshot.ID, i, run.Name, run.State, run.ExitCode, formatTime(run.Started), formatTime(run.Finished))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for i, status := range snapshot.Statuses {
+		_, err = tx.Exec(s.rebind(`INSERT INTO statuses (job_id, position, target, state, created) VALUES (?, ?, ?, ?, ?)`),
+			snapshot.ID, i, status.Target, status.State, formatTime(status.Time))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for i, a := range snapshot.Annotations {
+		_, err = tx.Exec(s.rebind(`INSERT INTO annotations (job_id, position, target, level, file, line, column_number,
+			title, message) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+			snapshot.ID, i, a.Target, a.Level, a.File, a.Line, a.Column, a.Title, a.Message)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for i, t := range snapshot.Tests {
+		_, err = tx.Exec(s.rebind(`INSERT INTO tests (job_id, position, target, suite, name, state, duration, message)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+			snapshot.ID, i, t.Target, t.Suite, t.Name, t.State, int64(t.Duration), t.Message)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlJobStore) Get(id string) (*Job, error) {
+	jobs, err := s.query(`WHERE id = ?`, id)
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+	return jobs[0], nil
+}
+
+func (s *sqlJobStore) List(filter JobFilter) ([]*Job, error) {
+	conditions, args := []string{"1 = 1"}, []interface{}{}
+	if filter.Repo != "" {
+		conditions, args = append(conditions, "repo = ?"), append(args, filter.Repo)
+	}
+	if filter.Branch != "" {
+		conditions, args = append(conditions, "branch = ?"), append(args, filter.Branch)
+	}
+	if filter.State != "" {
+		conditions, args = append(conditions, "state = ?"), append(args, filter.State)
+	}
+	clause := "WHERE " + strings.Join(conditions, " AND ") + " ORDER BY created DESC, id DESC"
+	if filter.Limit > 0 {
+		clause, args = clause+" LIMIT ? OFFSET ?", append(args, filter.Limit, filter.Offset)
+	}
+	return s.query(clause, args...)
+}
+
+// query returns the jobs selected by the clause, along with their targets,
+// statuses, annotations and tests.
+func (s *sqlJobStore) query(clause string, args ...interface{}) ([]*Job, error) {
+	rows, err := s.db.Query(s.rebind(`SELECT id, repo, ref, commit_sha, trigger_name, output_url, pr_number,
+		fork, state, created, started, finished, log_location FROM jobs `+clause), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []*Job{}
+	for rows.Next() {
+		job := NewJob("")
+		fork := 0
+		created, started, finished := "", "", ""
+		err = rows.Scan(&job.ID, &job.Repo, &job.Ref, &job.Commit, &job.Trigger, &job.OutputURL, &job.PRNumber,
+			&fork, &job.State, &created, &started, &finished, &job.LogLocation)
+		if err != nil {
+			return nil, err
+		}
+		job.Fork = fork != 0
+		job.Created, job.Started, job.Finished = parseTime(created), parseTime(started), parseTime(finished)
+		jobs = append(jobs, job)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err = s.queryDetails(jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// queryDetails loads the targets, statuses, annotations and tests of the
+// jobs, with a single query per table.
+func (s *sqlJobStore) queryDetails(jobs []*Job) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+	byID, ids := map[string]*Job{}, []interface{}{}
+	for _, job := range jobs {
+		byID[job.ID] = job
+		ids = append(ids, job.ID)
+	}
+	where := "WHERE job_id IN (?" + strings.Repeat(", ?", len(ids)-1) + ") ORDER BY job_id, position"
+
+	err := s.queryRows(`SELECT job_id, name, state, exit_code, started, finished FROM targets `+where, ids,
+		func(rows *sql.Rows) error {
+			id, run := "", &TargetRun{}
+			started, finished := "", ""
+			if err := rows.Scan(&id, &run.Name, &run.State, &run.ExitCode, &started, &finished); err != nil {
+				return err
+			}
+			run.Started, run.Finished = parseTime(started), parseTime(finished)
+			byID[id].Targets = append(byID[id].Targets, run)
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	err = s.queryRows(`SELECT job_id, target, state, created FROM statuses `+where, ids,
+		func(rows *sql.Rows) error {
+			id, status, created := "", StatusUpdate{}, ""
+			if err := rows.Scan(&id, &status.Target, &status.State, &created); err != nil {
+				return err
+			}
+			status.Time = parseTime(created)
+			byID[id].Statuses = append(byID[id].Statuses, status)
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	err = s.queryRows(`SELECT job_id, target, level, file, line, column_number, title, message
+		FROM annotations `+where, ids,
+		func(rows *sql.Rows) error {
+			id, a := "", Annotation{}
+			if err := rows.Scan(&id, &a.Target, &a.Level, &a.File, &a.Line, &a.Column, &a.Title, &a.Message); err != nil {
+				return err
+			}
+			byID[id].Annotations = append(byID[id].Annotations, a)
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	return s.queryRows(`SELECT job_id, target, suite, name, state, duration, message FROM tests `+where, ids,
+		func(rows *sql.Rows) error {
+			id, t, duration := "", TestResult{}, int64(0)
+			if err := rows.Scan(&id, &t.Target, &t.Suite, &t.Name, &t.State, &duration, &t.Message); err != nil {
+				return err
+			}
+			t.Duration = time.Duration(duration)
+			byID[id].Tests = append(byID[id].Tests, t)
+			return nil
+		})
+}
+
+// queryRows calls scan on every row returned by the query.
+func (s *sqlJobStore) queryRows(query string, args []interface{}, scan func(*sql.Rows) error) error {
+	rows, err := s.db.Query(s.rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Times are stored as UTC RFC3339 strings, which sort chronologically, the
+// zero time as the empty string.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02T15:04:05.000000000Z")
+}
+
+func parseTime(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	t, _ := time.Parse(time.RFC3339Nano, s)
+	return t
+}
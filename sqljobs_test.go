@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQLJobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	source := filepath.Join(dir, "jobs.db")
+
+	store, err := NewSQLJobStore(SQL_DRIVER_SQLITE, source)
+	assert.Nil(t, err)
+
+	green := NewJob(TRIGGER_PUSH)
+	green.Repo, green.Ref, green.Commit = "owner/repo", "refs/heads/master", "abc"
+	green.Start()
+	green.FinishTarget(green.StartTarget("jarvis-ci-test"), nil)
+	green.AddStatus("jarvis-ci-test", "success")
+	green.AddAnnotation(Annotation{Target: "jarvis-ci-test", Level: ANNOTATION_WARNING, File: "main.go", Line: 3, Message: "unused"})
+	green.AddTests("jarvis-ci-test", []TestResult{{Suite: "pkg", Name: "TestX", State: TEST_FAILED, Duration: 1500 * time.Millisecond, Message: "boom"}})
+	green.Finish(JOB_SUCCESS)
+	assert.Nil(t, store.Save(green))
+
+	red := NewJob(TRIGGER_PUSH)
+	red.Repo, red.Ref, red.Commit = "owner/repo", "refs/heads/master", "def"
+	red.Finish(JOB_FAILURE)
+	assert.Nil(t, store.Save(red))
+
+	// Migrations are only applied once
+	store, err = NewSQLJobStore(SQL_DRIVER_SQLITE, source)
+	assert.Nil(t, err)
+
+	job, err := store.Get(green.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", job.Commit)
+	assert.Len(t, job.Targets, 1)
+	assert.Equal(t, JOB_SUCCESS, job.Targets[0].State)
+	assert.Len(t, job.Statuses, 1)
+	assert.Equal(t, green.Annotations, job.Annotations)
+	assert.Equal(t, green.Tests, job.Tests)
+
+	job, err = LastJob(store, "owner/repo", "master", JOB_SUCCESS)
+	assert.Nil(t, err)
+	assert.Equal(t, green.ID, job.ID)
+
+	jobs, err := store.List(JobFilter{Repo: "owner/repo", Limit: 10})
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 2)
+	for _, job := range jobs {
+		if job.ID == green.ID {
+			assert.Len(t, job.Targets, 1)
+			assert.Equal(t, green.Tests, job.Tests)
+		} else {
+			assert.Len(t, job.Targets, 0)
+			assert.Len(t, job.Tests, 0)
+		}
+	}
+}
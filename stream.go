@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	STREAM_POLL_INTERVAL = time.Second
+)
+
+// broadcastOutputHandler wakes up the readers waiting on the output of a job
+// every time a line is added to it.
+type broadcastOutputHandler struct {
+	OutputHandler
+	waiters map[string]map[chan struct{}]bool
+	lock    *sync.Mutex
+}
+
+var _ OutputHandler = &broadcastOutputHandler{}
+
+func NewBroadcastOutputHandler(handler OutputHandler) *broadcastOutputHandler {
+	h := &broadcastOutputHandler{}
+	h.OutputHandler = handler
+	h.waiters = map[string]map[chan struct{}]bool{}
+	h.lock = &sync.Mutex{}
+	return h
+}
+
+func (h *broadcastOutputHandler) AddOutput(jobid string, target string, stream string, text string) {
+	h.OutputHandler.AddOutput(jobid, target, stream, text)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for wait := range h.waiters[jobid] {
+		close(wait)
+	}
+	delete(h.waiters, jobid)
+}
+
+// Wait returns a channel closed on the next output of the job, and the
+// function to call if it is no longer waited on.
+func (h *broadcastOutputHandler) Wait(jobid string) (<-chan struct{}, func()) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	wait := make(chan struct{})
+	if h.waiters[jobid] == nil {
+		h.waiters[jobid] = map[chan struct{}]bool{}
+	}
+	h.waiters[jobid][wait] = true
+
+	cancel := func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		delete(h.waiters[jobid], wait)
+		if len(h.waiters[jobid]) == 0 {
+			delete(h.waiters, jobid)
+		}
+	}
+	return wait, cancel
+}
+
+// streamOffset returns the number of lines the client already has, from the
+// Last-Event-ID header of a reconnecting EventSource or the from parameter.
+func streamOffset(req *http.Request) int {
+	value := req.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = req.URL.Query().Get("from")
+	}
+	offset, err := strconv.Atoi(value)
+	if err != nil || offset < 0 {
+		return 0
+	}
+	return offset
+}
+
+// jobDone returns whether no more output will be added to the job. Jobs
+// unknown to the store are done.
+func jobDone(jobs JobStore, jobid string) bool {
+	job, err := jobs.Get(jobid)
+	if err != nil {
+		glog.Warningf("Failed to get job %s: %v", jobid, err)
+		return false
+	}
+	return job == nil || job.Done()
+}
+
+// serveStream streams the output of the job as Server-Sent Events, one
+// record in JSON per event with the line number as its id, starting after
+// the offset. Once the job is done it sends an end event and closes the
+// stream.
+func serveStream(w http.ResponseWriter, req *http.Request, outputs *broadcastOutputHandler, jobs JobStore, jobid string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	ticker := time.NewTicker(STREAM_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	offset := streamOffset(req)
+	for {
+		// Wait before reading, so that no line added in between is missed
+		wait, cancel := outputs.Wait(jobid)
+		done := jobDone(jobs, jobid)
+		records := outputs.GetOutput(jobid)
+		for ; offset < len(records); offset++ {
+			data, _ := json.Marshal(records[offset])
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", records[offset].Line, data)
+		}
+		if done {
+			cancel()
+			fmt.Fprint(w, "event: end\ndata: done\n\n")
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-wait:
+		case <-ticker.C:
+		case <-req.Context().Done():
+			cancel()
+			return
+		}
+		cancel()
+	}
+}
+
+var livePage = template.Must(template.New("live").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Job {{.}}</title>
+<style>
+body { margin: 0; font-family: sans-serif; }
+header { padding: 8px 16px; background: #24292e; color: #fff; }
+pre { margin: 0; padding: 16px; font-size: 13px; white-space: pre-wrap; }
+.stderr { color: #cb2431; }
+.jarvis { color: #6a737d; }
+</style>
+</head>
+<body>
+<header>Job {{.}} <span id="state">running</span></header>
+<pre id="log"></pre>
+<script>
+var log = document.getElementById("log");
+var source = new EventSource("stream");
+function following() {
+  return window.innerHeight + window.scrollY >= document.body.scrollHeight - 32;
+}
+var target = "";
+source.onmessage = function(e) {
+  var record = JSON.parse(e.data);
+  var follow = following();
+  if ((record.target || "") != target) {
+    target = record.target || "";
+    log.appendChild(document.createTextNode(target ? "TARGET: " + target + "\n-------\n" : "\n"));
+  }
+  var line = document.createElement("span");
+  line.className = record.stream;
+  line.textContent = record.text.replace(/\x1b\[[0-9;?]*[ -\/]*[@-~]/g, "") + "\n";
+  log.appendChild(line);
+  if (follow) {
+    window.scrollTo(0, document.body.scrollHeight);
+  }
+};
+source.addEventListener("end", function() {
+  source.close();
+  document.getElementById("state").textContent = "finished";
+});
+</script>
+</body>
+</html>
+`))
+
+// serveLivePage serves the page of the job following its output as it is
+// streamed.
+func serveLivePage(w http.ResponseWriter, jobid string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := livePage.Execute(w, jobid)
+	if err != nil {
+		glog.Errorf("Failed to render live page of %s: %v", jobid, err)
+	}
+}
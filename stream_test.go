@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamOutput(t *testing.T) {
+	outputs := NewBroadcastOutputHandler(NewOutputHandler(10))
+	jobs := NewMemoryJobStore(10)
+	job := NewJob(TRIGGER_PUSH)
+	job.Start()
+	jobs.Save(job)
+	outputs.AddOutput(job.ID, "test", STREAM_STDOUT, "first")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		serveStream(w, req, outputs, jobs, job.ID)
+	}))
+	defer server.Close()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		outputs.AddOutput(job.ID, "test", STREAM_STDOUT, "second")
+		outputs.AddOutput(job.ID, "test", STREAM_STDOUT, "third")
+		job.Finish(JOB_SUCCESS)
+		jobs.Save(job)
+	}()
+
+	resp, err := http.Get(server.URL)
+	assert.Nil(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), "id: 1\ndata: ")
+	assert.Contains(t, string(body), `"text":"first"}`)
+	assert.Contains(t, string(body), "id: 3\ndata: ")
+	assert.True(t, strings.HasSuffix(string(body), "event: end\ndata: done\n\n"))
+
+	// Resume after the second line
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Last-Event-ID", "2")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NotContains(t, string(body), "second")
+	assert.Contains(t, string(body), "id: 3\ndata: ")
+	assert.Contains(t, string(body), `"text":"third"}`)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TEST_PASSED  = "passed"
+	TEST_FAILED  = "failed"
+	TEST_SKIPPED = "skipped"
+
+	// The output kept of a failed test, in bytes.
+	TEST_MESSAGE_MAX = 4096
+)
+
+// TestResult is the outcome of one test run by a target, as reported by a
+// JUnit XML file or go test -json.
+type TestResult struct {
+	Target   string        `json:"target"`
+	Suite    string        `json:"suite"`
+	Name     string        `json:"name"`
+	State    string        `json:"state"`
+	Duration time.Duration `json:"duration"`
+	Message  string        `json:"message,omitempty"`
+}
+
+// testSummary counts the results of tests, such as "142 passed, 3 failed",
+// empty if there are none.
+func testSummary(results []TestResult) string {
+	counts := map[string]int{}
+	for _, result := range results {
+		counts[result.State]++
+	}
+	parts := []string{}
+	for _, state := range []string{TEST_PASSED, TEST_FAILED, TEST_SKIPPED} {
+		if counts[state] > 0 || (state == TEST_PASSED && len(results) > 0) {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[state], state))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// sortTests returns the results with the failed tests first, then the
+// skipped ones, each in their original order.
+func sortTests(results []TestResult) []TestResult {
+	sorted := append(testsByState{}, results...)
+	sort.Stable(sorted)
+	return sorted
+}
+
+var testStateRanks = map[string]int{TEST_FAILED: 0, TEST_SKIPPED: 1, TEST_PASSED: 2}
+
+type testsByState []TestResult
+
+func (t testsByState) Len() int      { return len(t) }
+func (t testsByState) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t testsByState) Less(i, j int) bool {
+	return testStateRanks[t[i].State] < testStateRanks[t[j].State]
+}
+
+// junitSuite is a testsuite or testsuites element of a JUnit XML report.
+type junitSuite struct {
+	Name   string       `xml:"name,attr"`
+	Suites []junitSuite `xml:"testsuite"`
+	Cases  []junitCase  `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure"`
+	Error     *junitFailure `xml:"error"`
+	Skipped   *junitFailure `xml:"skipped"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// loadJUnitReports parses the JUnit XML reports matching the globs,
+// relative to the root of the repository cloned in workdir.
+func loadJUnitReports(workdir string, patterns []string) ([]TestResult, error) {
+	results := []TestResult{}
+	for _, pattern := range patterns {
+		matches, err := reportFiles(workdir, pattern)
+		if err != nil {
+			return results, err
+		}
+		for _, match := range matches {
+			content, err := ioutil.ReadFile(match)
+			if err != nil {
+				return results, err
+			}
+			parsed, err := parseJUnit(content)
+			if err != nil {
+				return results, fmt.Errorf("Failed to parse test report %s: %v", pattern, err)
+			}
+			results = append(results, parsed...)
+		}
+	}
+	return results, nil
+}
+
+// removeJUnitReports deletes the reports matching the globs, so that those
+// left by an earlier build in a persistent workspace are not read again.
+func removeJUnitReports(workdir string, patterns []string) error {
+	for _, pattern := range patterns {
+		matches, err := reportFiles(workdir, pattern)
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			if err = os.Remove(match); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reportFiles returns the files matching the glob, which cannot match
+// outside of workdir.
+func reportFiles(workdir string, pattern string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(workdir, filepath.Clean("/"+pattern)))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid report pattern %s: %v", pattern, err)
+	}
+	return matches, nil
+}
+
+// parseJUnit returns the results of the test cases of a JUnit XML report,
+// whether its root is a testsuites or a testsuite element.
+func parseJUnit(content []byte) ([]TestResult, error) {
+	root := junitSuite{}
+	err := xml.Unmarshal(content, &root)
+	if err != nil {
+		return nil, err
+	}
+	return root.results(), nil
+}
+
+func (s junitSuite) results() []TestResult {
+	results := []TestResult{}
+	for _, c := range s.Cases {
+		result := TestResult{Suite: c.ClassName, Name: c.Name, State: TEST_PASSED}
+		if result.Suite == "" {
+			result.Suite = s.Name
+		}
+		seconds, _ := strconv.ParseFloat(strings.Replace(c.Time, ",", "", -1), 64)
+		result.Duration = time.Duration(seconds * float64(time.Second))
+		for _, failure := range []*junitFailure{c.Failure, c.Error} {
+			if failure != nil {
+				result.State = TEST_FAILED
+				result.Message = testMessage(failure.Message + "\n" + failure.Text)
+			}
+		}
+		if c.Skipped != nil && result.State == TEST_PASSED {
+			result.State = TEST_SKIPPED
+			result.Message = testMessage(c.Skipped.Message)
+		}
+		results = append(results, result)
+	}
+	for _, suite := range s.Suites {
+		results = append(results, suite.results()...)
+	}
+	return results
+}
+
+// goTestEvent is a line of the output of go test -json.
+type goTestEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+// goTestParser reads the results of the tests of the output of
+// go test -json one line at a time, ignoring the lines that are not events.
+// Only the output of the tests still running is kept.
+type goTestParser struct {
+	outputs map[string]string
+	results []TestResult
+}
+
+func newGoTestParser() *goTestParser {
+	return &goTestParser{outputs: map[string]string{}, results: []TestResult{}}
+}
+
+// Add parses a line of the output.
+func (p *goTestParser) Add(line string) {
+	event := goTestEvent{}
+	if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &event) != nil || event.Test == "" {
+		return
+	}
+
+	key := event.Package + " " + event.Test
+	state := ""
+	switch event.Action {
+	case "output":
+		if len(p.outputs[key]) < TEST_MESSAGE_MAX {
+			p.outputs[key] += event.Output
+		}
+	case "pass":
+		state = TEST_PASSED
+	case "fail":
+		state = TEST_FAILED
+	case "skip":
+		state = TEST_SKIPPED
+	}
+	if state == "" {
+		return
+	}
+
+	result := TestResult{Suite: event.Package, Name: event.Test, State: state}
+	result.Duration = time.Duration(event.Elapsed * float64(time.Second))
+	if state != TEST_PASSED {
+		result.Message = testMessage(p.outputs[key])
+	}
+	delete(p.outputs, key)
+	p.results = append(p.results, result)
+}
+
+// Results returns the results of the tests that finished.
+func (p *goTestParser) Results() []TestResult {
+	return p.results
+}
+
+// testMessage trims the message of a test to TEST_MESSAGE_MAX bytes.
+func testMessage(message string) string {
+	message = strings.TrimSpace(message)
+	if len(message) > TEST_MESSAGE_MAX {
+		message = message[:TEST_MESSAGE_MAX]
+	}
+	return message
+}
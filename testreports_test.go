@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadJUnitReports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jarvis-reports")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	report := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="api" tests="3">
+    <testcase classname="api.Users" name="creates" time="0.25"/>
+    <testcase classname="api.Users" name="deletes" time="1,000.5">
+      <failure message="expected 204">got 500</failure>
+    </testcase>
+    <testcase name="lists"><skipped message="flaky"/></testcase>
+  </testsuite>
+</testsuites>`
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "reports"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "reports", "api.xml"), []byte(report), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "reports", "ui.xml"), []byte(`<testsuite name="ui"><testcase name="renders"/></testsuite>`), 0644))
+
+	results, err := loadJUnitReports(dir, []string{"reports/*.xml", "missing/*.xml"})
+	assert.Nil(t, err)
+	assert.Equal(t, []TestResult{
+		{Suite: "api.Users", Name: "creates", State: TEST_PASSED, Duration: 250 * time.Millisecond},
+		{Suite: "api.Users", Name: "deletes", State: TEST_FAILED, Duration: 1000500 * time.Millisecond, Message: "expected 204\ngot 500"},
+		{Suite: "api", Name: "lists", State: TEST_SKIPPED, Message: "flaky"},
+		{Suite: "ui", Name: "renders", State: TEST_PASSED},
+	}, results)
+	assert.Equal(t, "2 passed, 1 failed, 1 skipped", testSummary(results))
+
+	sorted := sortTests(results)
+	assert.Equal(t, []string{"deletes", "lists", "creates", "renders"},
+		[]string{sorted[0].Name, sorted[1].Name, sorted[2].Name, sorted[3].Name})
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "reports", "broken.xml"), []byte("<testsuite"), 0644))
+	_, err = loadJUnitReports(dir, []string{"reports/broken.xml"})
+	assert.NotNil(t, err)
+
+	// Reports left by an earlier build are removed before the target runs
+	assert.Nil(t, removeJUnitReports(dir, []string{"reports/*.xml"}))
+	results, err = loadJUnitReports(dir, []string{"reports/*.xml"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(results))
+	_, err = os.Stat(filepath.Join(dir, "reports"))
+	assert.Nil(t, err)
+}
+
+func TestGoTestParser(t *testing.T) {
+	parser := newGoTestParser()
+	for _, line := range []string{
+		`go: downloading github.com/stretchr/testify v1.8.0`,
+		`{"Action":"run","Package":"example.com/pkg","Test":"TestA"}`,
+		`{"Action":"output","Package":"example.com/pkg","Test":"TestA","Output":"=== RUN   TestA\n"}`,
+		`{"Action":"pass","Package":"example.com/pkg","Test":"TestA","Elapsed":0.01}`,
+		`{"Action":"run","Package":"example.com/pkg","Test":"TestB"}`,
+		`{"Action":"output","Package":"example.com/pkg","Test":"TestB","Output":"    b_test.go:9: wrong\n"}`,
+		`{"Action":"fail","Package":"example.com/pkg","Test":"TestB","Elapsed":1.5}`,
+		`{"Action":"skip","Package":"example.com/pkg","Test":"TestC","Elapsed":0}`,
+		`{"Action":"fail","Package":"example.com/pkg","Elapsed":1.6}`,
+	} {
+		parser.Add(line)
+	}
+	results := parser.Results()
+	assert.Equal(t, 0, len(parser.outputs))
+	assert.Equal(t, []TestResult{
+		{Suite: "example.com/pkg", Name: "TestA", State: TEST_PASSED, Duration: 10 * time.Millisecond},
+		{Suite: "example.com/pkg", Name: "TestB", State: TEST_FAILED, Duration: 1500 * time.Millisecond, Message: "b_test.go:9: wrong"},
+		{Suite: "example.com/pkg", Name: "TestC", State: TEST_SKIPPED},
+	}, results)
+	assert.Equal(t, "", testSummary(nil))
+}
+
+func TestCollectTestsMasksMessages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jarvis-reports")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	report := `<testsuite name="api"><testcase name="logs in"><failure message="bad token hunter2-pass"/></testcase></testsuite>`
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "report.xml"), []byte(report), 0644))
+
+	h := &eventHandler{outputhandler: NewOutputHandler(10)}
+	h.values = func() []string { return []string{"hunter2-pass"} }
+	job := NewJob(TRIGGER_PUSH)
+	h.collectTests(&Runner{clonedir: dir}, job, "test", TargetConfig{Reports: []string{"report.xml"}}, newGoTestParser())
+	assert.Equal(t, 1, len(job.Tests))
+	assert.Equal(t, "bad token ***", job.Tests[0].Message)
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	UI_PAGE_SIZE         = 50
+	UI_BRANCH_JOBS       = 500
+	UI_BRANCH_HISTORY    = 10
+	UI_DURATION_ROUNDING = time.Second
+)
+
+// webUI serves the HTML pages of the jobs under {BasePath}/ui/: the list of
+// jobs at jobs, the page of a job at jobs/{id}, and the health of the
+// branches of a repository at repos/{owner}/{repo}.
+type webUI struct {
+	jobs      JobStore
+	outputs   OutputHandler
+	artifacts *artifactStore
+}
+
+func NewWebUI(jobs JobStore, outputs OutputHandler, artifacts *artifactStore) *webUI {
+	ui := &webUI{}
+	ui.jobs = jobs
+	ui.outputs = outputs
+	ui.artifacts = artifacts
+	return ui
+}
+
+func (ui *webUI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	glog.Infof("Handling UI request: %s", req.URL.Path)
+	rest := strings.Trim(strings.TrimPrefix(req.URL.Path, path.Join(BasePath, "/ui")), "/")
+	switch {
+	case rest == "" || rest == "jobs":
+		ui.serveJobs(w, req)
+	case strings.HasPrefix(rest, "jobs/"):
+		ui.serveJob(w, req, strings.TrimPrefix(rest, "jobs/"))
+	case strings.HasPrefix(rest, "repos/") && strings.Count(rest, "/") == 2:
+		ui.serveRepo(w, req, strings.TrimPrefix(rest, "repos/"))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (ui *webUI) serveJobs(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	page, _ := strconv.Atoi(query.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	filter := JobFilter{
+		Repo:   query.Get("repo"),
+		Branch: query.Get("branch"),
+		State:  query.Get("state"),
+		Limit:  UI_PAGE_SIZE,
+		Offset: (page - 1) * UI_PAGE_SIZE,
+	}
+	jobs, err := ui.jobs.List(filter)
+	if err != nil {
+		glog.Errorf("Failed to list jobs: %v", err)
+		http.Error(w, "Failed to list jobs", http.StatusInternalServerError)
+		return
+	}
+
+	// Keep the filters in the links to the other pages
+	link := func(page int) string {
+		query.Set("page", strconv.Itoa(page))
+		return "?" + query.Encode()
+	}
+	data := map[string]interface{}{
+		"Title":  "Jobs",
+		"Filter": filter,
+		"States": []string{JOB_PENDING, JOB_RUNNING, JOB_SUCCESS, JOB_FAILURE, JOB_ERROR},
+		"Jobs":   jobs,
+	}
+	if page > 1 {
+		data["Previous"] = link(page - 1)
+	}
+	if len(jobs) == UI_PAGE_SIZE {
+		data["Next"] = link(page + 1)
+	}
+	ui.render(w, "jobs", data)
+}
+
+func (ui *webUI) serveJob(w http.ResponseWriter, req *http.Request, jobid string) {
+	job, err := ui.jobs.Get(jobid)
+	if err != nil {
+		glog.Errorf("Failed to get job %s: %v", jobid, err)
+		http.Error(w, "Failed to get job", http.StatusInternalServerError)
+		return
+	} else if job == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	artifacts, err := ui.artifacts.List(jobid)
+	if err != nil {
+		glog.Warningf("Failed to list artifacts of %s: %v", jobid, err)
+	}
+	ui.render(w, "job", map[string]interface{}{
+		"Title":     job.ID,
+		"Job":       job,
+		"Sections":  uiSections(ui.outputs.GetOutput(jobid), job),
+		"Tests":     sortTests(job.Tests),
+		"Artifacts": artifacts,
+	})
+}
+
+// uiSection is the output of a target along with its run, if known.
+type uiSection struct {
+	logSection
+	Run   *TargetRun
+	Lines []uiLine
+}
+
+// uiLine is a record along with its text rendered as HTML, and the lines
+// of the group it opens if any.
+type uiLine struct {
+	LogRecord
+	HTML  template.HTML
+	Group []uiLine
+}
+
+// uiSections returns the sections of the output, paired with the runs of
+// the job if not nil.
+func uiSections(records []LogRecord, job *Job) []uiSection {
+	runs := map[string]*TargetRun{}
+	if job != nil {
+		for _, run := range job.Targets {
+			runs[run.Name] = run
+		}
+	}
+	sections := []uiSection{}
+	for _, section := range logSections(records) {
+		lines, _ := uiLines(section.Records, &ansiRenderer{}, 0)
+		sections = append(sections, uiSection{section, runs[section.Target], lines})
+	}
+	return sections
+}
+
+// uiLines renders the records until the end of the group at the depth,
+// nesting the groups they open. It returns the number of records used.
+func uiLines(records []LogRecord, renderer *ansiRenderer, depth int) ([]uiLine, int) {
+	lines := []uiLine{}
+	for i := 0; i < len(records); i++ {
+		record := records[i]
+		switch record.Stream {
+		case STREAM_ENDGROUP:
+			if depth > 0 {
+				return lines, i + 1
+			}
+		case STREAM_GROUP:
+			group, n := uiLines(records[i+1:], renderer, depth+1)
+			lines = append(lines, uiLine{record, renderer.Render(record.Text), group})
+			i += n
+		default:
+			lines = append(lines, uiLine{record, renderer.Render(record.Text), nil})
+		}
+	}
+	return lines, len(records)
+}
+
+// branchHealth is the recent history of a branch, most recent job first.
+type branchHealth struct {
+	Name        string
+	Jobs        []*Job
+	LastSuccess *Job
+}
+
+// branchesByRecency sorts branches by their most recent job, newest first.
+type branchesByRecency []*branchHealth
+
+func (b branchesByRecency) Len() int      { return len(b) }
+func (b branchesByRecency) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b branchesByRecency) Less(i, j int) bool {
+	return b[i].Jobs[0].Created.After(b[j].Jobs[0].Created)
+}
+
+func (ui *webUI) serveRepo(w http.ResponseWriter, req *http.Request, repo string) {
+	jobs, err := ui.jobs.List(JobFilter{Repo: repo, Limit: UI_BRANCH_JOBS})
+	if err != nil {
+		glog.Errorf("Failed to list jobs of %s: %v", repo, err)
+		http.Error(w, "Failed to list jobs", http.StatusInternalServerError)
+		return
+	}
+
+	branches := map[string]*branchHealth{}
+	order := []*branchHealth{}
+	for _, job := range jobs {
+		branch := branches[job.Branch()]
+		if branch == nil {
+			branch = &branchHealth{Name: job.Branch()}
+			branches[job.Branch()] = branch
+			order = append(order, branch)
+		}
+		if len(branch.Jobs) < UI_BRANCH_HISTORY {
+			branch.Jobs = append(branch.Jobs, job)
+		}
+		if branch.LastSuccess == nil && job.State == JOB_SUCCESS {
+			branch.LastSuccess = job
+		}
+	}
+	sort.Stable(branchesByRecency(order))
+	ui.render(w, "repo", map[string]interface{}{
+		"Title":    repo,
+		"Repo":     repo,
+		"Branches": order,
+	})
+}
+
+func (ui *webUI) render(w http.ResponseWriter, name string, data map[string]interface{}) {
+	data["Base"] = path.Join(BasePath, "/ui")
+	data["BasePath"] = BasePath
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := uiTemplates.ExecuteTemplate(w, name, data)
+	if err != nil {
+		glog.Errorf("Failed to render %s page: %v", name, err)
+	}
+}
+
+// jobDuration returns how long the job or target ran, or has been running.
+func jobDuration(started time.Time, finished time.Time) string {
+	if started.IsZero() {
+		return ""
+	} else if finished.IsZero() {
+		return roundDuration(time.Since(started)).String()
+	}
+	return roundDuration(finished.Sub(started)).String()
+}
+
+// roundDuration rounds the duration to the nearest UI_DURATION_ROUNDING,
+// halfway values away from zero.
+func roundDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -roundDuration(-d)
+	}
+	return (d + UI_DURATION_ROUNDING/2) / UI_DURATION_ROUNDING * UI_DURATION_ROUNDING
+}
+
+var uiFuncs = template.FuncMap{
+	"css": func() template.CSS {
+		return template.CSS(ansiCSS)
+	},
+	"duration": jobDuration,
+	"short": func(sha string) string {
+		if len(sha) > 8 {
+			return sha[:8]
+		}
+		return sha
+	},
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("2006-01-02 15:04:05")
+	},
+	"tests": testSummary,
+	"failed": func(run *TargetRun) bool {
+		return run != nil && run.State != JOB_SUCCESS
+	},
+}
+
+var uiTemplates = template.Must(template.New("ui").Funcs(uiFuncs).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}} - jarvis-ci</title>
+<style>
+body { margin: 0; font-family: sans-serif; font-size: 14px; color: #24292e; }
+nav { padding: 8px 16px; background: #24292e; }
+nav a { color: #fff; margin-right: 16px; text-decoration: none; }
+main { padding: 16px; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #e1e4e8; }
+pre { margin: 0; padding: 8px; background: #f6f8fa; font-size: 12px; white-space: pre-wrap; }
+details { margin: 8px 0; border: 1px solid #e1e4e8; }
+summary { padding: 8px; cursor: pointer; background: #fafbfc; }
+.badge { display: inline-block; padding: 1px 6px; border-radius: 3px; color: #fff; font-size: 12px; background: #6a737d; }
+.badge.success { background: #28a745; }
+.badge.failure { background: #cb2431; }
+.badge.error { background: #b08800; }
+.badge.running { background: #0366d6; }
+.badge.test-passed { background: #28a745; }
+.badge.test-failed { background: #cb2431; }
+.badge.annotation-error { background: #cb2431; }
+.badge.annotation-warning { background: #b08800; }
+.badge.annotation-notice { background: #0366d6; }
+.line { display: block; }
+details.group { margin: 0; border: none; }
+details.group > summary.line { display: list-item; padding: 0; background: none; font-weight: bold; }
+.line.hl { background: #fffbdd; }
+.ln { display: inline-block; width: 48px; margin-right: 8px; color: #959da5; text-align: right; text-decoration: none; user-select: none; }
+.stderr { color: #cb2431; }
+.jarvis { color: #6a737d; }
+{{css}}
+</style>
+<script>
+// Highlight the lines of #L12 or #L12-L20, shift-click extends the range
+var anchor = null;
+function highlight() {
+  var match = /^#L(\d+)(?:-L(\d+))?$/.exec(location.hash);
+  document.querySelectorAll(".line.hl").forEach(function(line) { line.classList.remove("hl"); });
+  if (!match) {
+    return;
+  }
+  var first = parseInt(match[1]), last = parseInt(match[2] || match[1]);
+  for (var n = Math.min(first, last); n <= Math.max(first, last); n++) {
+    var line = document.getElementById("L" + n);
+    if (line) {
+      line.classList.add("hl");
+      for (var details = line.parentNode.closest("details"); details; details = details.parentNode.closest("details")) {
+        details.open = true;
+      }
+    }
+  }
+  var start = document.getElementById("L" + first);
+  if (start) {
+    start.scrollIntoView({block: "center"});
+  }
+}
+document.addEventListener("click", function(e) {
+  if (!e.target.classList.contains("ln")) {
+    return;
+  }
+  e.preventDefault();
+  var line = e.target.parentNode.id;
+  location.hash = e.shiftKey && anchor ? anchor + "-" + line : line;
+  if (!e.shiftKey) {
+    anchor = line;
+  }
+});
+window.addEventListener("hashchange", highlight);
+window.addEventListener("DOMContentLoaded", highlight);
+</script>
+</head>
+<body>
+<nav><a href="{{.Base}}/jobs">jarvis-ci</a></nav>
+<main>
+{{end}}
+
+{{define "footer"}}</main>
+</body>
+</html>
+{{end}}
+
+{{define "badge"}}<span class="badge {{.}}">{{.}}</span>{{end}}
+
+{{define "jobs"}}{{template "header" .}}
+<form method="get">
+<input name="repo" placeholder="owner/repo" value="{{.Filter.Repo}}">
+<input name="branch" placeholder="branch" value="{{.Filter.Branch}}">
+<select name="state"><option value="">any state</option>
+{{$state := .Filter.State}}{{range .States}}<option{{if eq . $state}} selected{{end}}>{{.}}</option>{{end}}
+</select>
+<button type="submit">Filter</button>
+</form>
+<table>
+<tr><th>Job</th><th>State</th><th>Repository</th><th>Branch</th><th>Commit</th><th>Created</th><th>Duration</th></tr>
+{{range .Jobs}}<tr>
+<td><a href="{{$.Base}}/jobs/{{.ID}}">{{.ID}}</a></td>
+<td>{{template "badge" .State}}</td>
+<td><a href="{{$.Base}}/repos/{{.Repo}}">{{.Repo}}</a></td>
+<td>{{.Branch}}</td>
+<td>{{short .Commit}}</td>
+<td>{{time .Created}}</td>
+<td>{{duration .Started .Finished}}</td>
+</tr>{{else}}<tr><td colspan="7">No jobs.</td></tr>{{end}}
+</table>
+<p>{{with .Previous}}<a href="{{.}}">Previous</a> {{end}}{{with .Next}}<a href="{{.}}">Next</a>{{end}}</p>
+{{template "footer"}}{{end}}
+
+{{define "job"}}{{template "header" .}}
+{{$base := .BasePath}}{{with .Job}}
+<h2>{{.ID}} {{template "badge" .State}}</h2>
+{{with .Annotations}}<table>
+<tr><th>Annotation</th><th>Location</th><th>Target</th><th>Message</th></tr>
+{{range .}}<tr><td><span class="badge annotation-{{.Level}}">{{.Level}}</span></td>
+<td>{{if .File}}<a href="https://github.com/{{$.Job.Repo}}/blob/{{$.Job.Commit}}/{{.File}}{{if .Line}}#L{{.Line}}{{end}}">{{.Location}}</a>{{end}}</td>
+<td>{{.Target}}</td><td>{{with .Title}}<b>{{.}}</b> {{end}}{{.Message}}</td></tr>
+{{end}}</table>{{end}}
+<h3>Job</h3>
+<table>
+<tr><th>Repository</th><td><a href="{{$.Base}}/repos/{{.Repo}}">{{.Repo}}</a></td></tr>
+<tr><th>Ref</th><td>{{.Ref}}</td></tr>
+<tr><th>Commit</th><td>{{.Commit}}</td></tr>
+<tr><th>Trigger</th><td>{{.Trigger}}</td></tr>
+<tr><th>Created</th><td>{{time .Created}}</td></tr>
+<tr><th>Duration</th><td>{{duration .Started .Finished}}</td></tr>
+<tr><th>Output</th><td><a href="{{$base}}/outputs/{{.ID}}">raw</a> <a href="{{$base}}/outputs/{{.ID}}?ansi=strip">raw without colors</a> <a href="{{$base}}/outputs/{{.ID}}?download=1">download</a>{{if not .Done}} <a href="{{$base}}/outputs/{{.ID}}/live">live</a>{{end}}</td></tr>
+</table>
+<h3>Targets</h3>
+<table>
+<tr><th>Target</th><th>State</th><th>Exit code</th><th>Duration</th></tr>
+{{range .Targets}}<tr><td>{{.Name}}</td><td>{{template "badge" .State}}</td><td>{{.ExitCode}}</td><td>{{duration .Started .Finished}}</td></tr>
+{{else}}<tr><td colspan="4">No targets ran.</td></tr>{{end}}
+</table>
+{{end}}
+{{with .Tests}}<h3>Tests</h3>
+<p>{{tests .}}</p>
+<table>
+<tr><th>Test</th><th>State</th><th>Target</th><th>Duration</th></tr>
+{{range .}}<tr><td>{{with .Suite}}{{.}} {{end}}<b>{{.Name}}</b>{{with .Message}}<details><summary>output</summary><pre>{{.}}</pre></details>{{end}}</td>
+<td><span class="badge test-{{.State}}">{{.State}}</span></td><td>{{.Target}}</td><td>{{.Duration}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Artifacts}}<h3>Artifacts</h3>
+<ul>{{$id := .Job.ID}}{{range .Artifacts}}<li><a href="{{$base}}/jobs/{{$id}}/artifacts/{{.Path}}">{{.Path}}</a> ({{.Size}} bytes)</li>{{end}}</ul>
+{{end}}
+<h3>Logs</h3>
+{{if .Sections}}{{template "sections" .Sections}}
+{{else}}<p>No output{{if .Job.LogLocation}}, see the <a href="{{$base}}/outputs/{{.Job.ID}}">archived log</a>{{end}}.</p>{{end}}
+{{template "footer"}}{{end}}
+
+{{define "sections"}}{{range .}}<details{{if failed .Run}} open{{end}}>
+<summary>{{if .Target}}{{.Target}}{{else}}jarvis{{end}}{{with .Run}} {{template "badge" .State}} {{duration .Started .Finished}}{{end}}</summary>
+<pre>{{template "lines" .Lines}}</pre>
+</details>
+{{end}}{{end}}
+
+{{define "lines"}}{{range .}}{{if eq .Stream "group"}}<details class="group"><summary class="line group" id="L{{.Line}}"><a class="ln" href="#L{{.Line}}">{{.Line}}</a>{{.HTML}}</summary>{{template "lines" .Group}}</details>{{else}}<span class="line {{.Stream}}" id="L{{.Line}}"><a class="ln" href="#L{{.Line}}">{{.Line}}</a>{{.HTML}}</span>{{end}}{{end}}{{end}}
+
+{{define "log"}}{{template "header" .}}
+<h2>Output of <a href="{{$.Base}}/jobs/{{.JobID}}">{{.JobID}}</a></h2>
+{{template "sections" .Sections}}
+{{template "footer"}}{{end}}
+
+{{define "repo"}}{{template "header" .}}
+<h2>{{.Repo}}</h2>
+<table>
+<tr><th>Branch</th><th>Latest</th><th>History</th><th>Last success</th></tr>
+{{range .Branches}}<tr>
+<td><a href="{{$.Base}}/jobs?repo={{$.Repo}}&amp;branch={{.Name}}">{{.Name}}</a></td>
+<td>{{with index .Jobs 0}}<a href="{{$.Base}}/jobs/{{.ID}}">{{template "badge" .State}}</a> {{time .Created}}{{end}}</td>
+<td>{{range .Jobs}}<a href="{{$.Base}}/jobs/{{.ID}}" title="{{.ID}}">{{template "badge" .State}}</a> {{end}}</td>
+<td>{{with .LastSuccess}}<a href="{{$.Base}}/jobs/{{.ID}}">{{time .Created}}</a>{{else}}never{{end}}</td>
+</tr>{{else}}<tr><td colspan="4">No jobs.</td></tr>{{end}}
+</table>
+{{template "footer"}}{{end}}
+`))
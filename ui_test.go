@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogSections(t *testing.T) {
+	outputs := NewOutputHandler(10)
+	outputs.AddOutput("job-1", "", STREAM_JARVIS, "JOB: job-1")
+	outputs.AddOutput("job-1", "test", STREAM_STDOUT, "ok")
+	outputs.AddOutput("job-1", "deploy", STREAM_STDOUT, "deploying")
+	outputs.AddOutput("job-1", "deploy", STREAM_STDERR, "failed")
+
+	sections := logSections(outputs.GetOutput("job-1"))
+	assert.Equal(t, 3, len(sections))
+	assert.Equal(t, "", sections[0].Target)
+	assert.Equal(t, "test", sections[1].Target)
+	assert.Equal(t, 2, sections[1].Records[0].Line)
+	assert.Equal(t, "deploy", sections[2].Target)
+
+	records, ok := targetLog(outputs.GetOutput("job-1"), "deploy")
+	assert.True(t, ok)
+	assert.Equal(t, 2, len(records))
+
+	out := &bytes.Buffer{}
+	assert.Nil(t, writeText(out, outputs.GetOutput("job-1")))
+	assert.Contains(t, out.String(), "TARGET: deploy\n-------\n")
+	assert.Contains(t, out.String(), "[stderr] failed\n=======\n")
+}
+
+func TestWebUI(t *testing.T) {
+	jobs := NewMemoryJobStore(10)
+	outputs := NewOutputHandler(10)
+	job := NewJob(TRIGGER_PUSH)
+	job.Repo, job.Ref = "owner/repo", "refs/heads/master"
+	job.Start()
+	run := job.StartTarget("jarvis-ci-test")
+	job.AddTests("jarvis-ci-test", []TestResult{{Name: "TestPasses", State: TEST_PASSED}, {Name: "TestFails", State: TEST_FAILED}})
+	job.FinishTarget(run, errors.New("exit status 2"))
+	job.Finish(JOB_FAILURE)
+	jobs.Save(job)
+	outputs.AddOutput(job.ID, "jarvis-ci-test", STREAM_STDOUT, "<b>injected</b>")
+
+	ui := NewWebUI(jobs, outputs, NewArtifactStore("/nonexistent", 0))
+	for _, page := range []string{"/jobs?repo=owner/repo", "/jobs/" + job.ID, "/repos/owner/repo"} {
+		w := httptest.NewRecorder()
+		ui.ServeHTTP(w, httptest.NewRequest("GET", BasePath+"/ui"+page, nil))
+		assert.Equal(t, 200, w.Code, page)
+		assert.Contains(t, w.Body.String(), job.ID, page)
+		assert.Contains(t, w.Body.String(), `class="badge failure"`, page)
+		assert.NotContains(t, w.Body.String(), "<b>injected", page)
+	}
+
+	// The failed tests come first
+	w := httptest.NewRecorder()
+	ui.ServeHTTP(w, httptest.NewRequest("GET", BasePath+"/ui/jobs/"+job.ID, nil))
+	page := w.Body.String()
+	assert.Contains(t, page, "1 passed, 1 failed")
+	assert.True(t, strings.Index(page, "TestFails") < strings.Index(page, "TestPasses"))
+
+	w = httptest.NewRecorder()
+	ui.ServeHTTP(w, httptest.NewRequest("GET", BasePath+"/ui/jobs/unknown", nil))
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestServeOutputFormats(t *testing.T) {
+	outputs := NewOutputHandler(10)
+	outputs.AddOutput("job-1", "test", STREAM_STDOUT, "100% <ok>")
+	records := outputs.GetOutput("job-1")
+
+	for format, expected := range map[string]string{
+		"":      "]   100% <ok>\n",
+		"text":  "TARGET: test\n",
+		"jsonl": `"target":"test","stream":"stdout","line":1,"text":"100% <ok>"}`,
+		"html":  `<span class="line stdout" id="L1"><a class="ln" href="#L1">1</a>100% &lt;ok&gt;</span>`,
+	} {
+		w := httptest.NewRecorder()
+		serveOutput(w, httptest.NewRequest("GET", "/outputs/job-1?format="+format, nil), "job-1", records)
+		assert.Equal(t, 200, w.Code, format)
+		assert.Contains(t, w.Body.String(), expected, format)
+	}
+
+	w := httptest.NewRecorder()
+	serveOutput(w, httptest.NewRequest("GET", "/outputs/job-1?format=xml", nil), "job-1", records)
+	assert.Equal(t, 400, w.Code)
+
+	outputs.AddOutput("job-1", "test", STREAM_STDOUT, "\x1b[31mred\x1b[0m")
+	records = outputs.GetOutput("job-1")
+	w = httptest.NewRecorder()
+	serveOutput(w, httptest.NewRequest("GET", "/outputs/job-1?ansi=strip&download=1", nil), "job-1", records)
+	assert.Contains(t, w.Body.String(), "]   red\n")
+	assert.Equal(t, `attachment; filename="job-1.log"`, w.Header().Get("Content-Disposition"))
+
+	w = httptest.NewRecorder()
+	serveOutput(w, httptest.NewRequest("GET", "/outputs/job-1?format=html", nil), "job-1", records)
+	assert.Contains(t, w.Body.String(), `<span class="ansi-fg-1">red</span>`)
+}
+
+func TestUILinesGroups(t *testing.T) {
+	outputs := NewOutputHandler(10)
+	outputs.AddOutput("job-1", "test", STREAM_GROUP, "Unit tests")
+	outputs.AddOutput("job-1", "test", STREAM_STDOUT, "ok")
+	outputs.AddOutput("job-1", "test", STREAM_GROUP, "Race")
+	outputs.AddOutput("job-1", "test", STREAM_STDOUT, "ok")
+	outputs.AddOutput("job-1", "test", STREAM_ENDGROUP, "")
+	outputs.AddOutput("job-1", "test", STREAM_ENDGROUP, "")
+	outputs.AddOutput("job-1", "test", STREAM_ENDGROUP, "")
+	outputs.AddOutput("job-1", "test", STREAM_STDOUT, "done")
+
+	lines, _ := uiLines(outputs.GetOutput("job-1"), &ansiRenderer{}, 0)
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, "Unit tests", lines[0].Text)
+	assert.Equal(t, 2, len(lines[0].Group))
+	assert.Equal(t, "Race", lines[0].Group[1].Text)
+	assert.Equal(t, 1, len(lines[0].Group[1].Group))
+	assert.Equal(t, "done", lines[1].Text)
+	assert.Equal(t, 8, lines[1].Line)
+}
+
+func TestJobDuration(t *testing.T) {
+	started := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, "", jobDuration(time.Time{}, started))
+	assert.Equal(t, "1m5s", jobDuration(started, started.Add(64500*time.Millisecond)))
+	assert.Equal(t, "1m4s", jobDuration(started, started.Add(64499*time.Millisecond)))
+	assert.Equal(t, "-2s", jobDuration(started, started.Add(-1500*time.Millisecond)))
+}
@@ -1,17 +1,22 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"sync/atomic"
+	"time"
 )
 
 var (
 	counter uint64
 )
 
+// newJobID returns an ID unique across restarts, which sorts by creation time.
 func newJobID() string {
-	newNumber := atomic.AddUint64(&counter, 1)
-	return fmt.Sprintf("%d", newNumber)
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102-150405"), hex.EncodeToString(suffix))
 }
 
 func getCloneDir() string {
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	WORKSPACE_CLEAN_NONE      = "none"
+	WORKSPACE_CLEAN_UNTRACKED = "untracked"
+	WORKSPACE_CLEAN_ALL       = "all"
+)
+
+var (
+	WorkspacesDir      string
+	WorkspaceClean     string
+	WorkspacesMaxSize  int64
+	WorkspacesMaxCount int
+)
+
+func init() {
+	flag.StringVar(&WorkspacesDir, "workspaces-dir", "", "The directory of the persistent workspaces, one per repository and branch. Empty to clone every build from scratch")
+	flag.StringVar(&WorkspaceClean, "workspace-clean", WORKSPACE_CLEAN_UNTRACKED, "What to clean from a persistent workspace before a build: none, untracked (keeps ignored files) or all")
+	flag.Int64Var(&WorkspacesMaxSize, "workspaces-max-size", 10*1024, "The disk budget in MB of the persistent workspaces")
+	flag.IntVar(&WorkspacesMaxCount, "workspaces-max-count", 20, "The maximum number of persistent workspaces")
+}
+
+// workspacePool hands out one persistent workspace per repository and
+// branch, to one job at a time, and evicts the least recently used ones to
+// stay within its budget. The sizes of the workspaces are recorded when they
+// are released.
+type workspacePool struct {
+	dir      string
+	maxsize  int64
+	maxcount int
+	locks    map[string]*sync.Mutex
+	sizes    map[string]int64
+	lock     *sync.Mutex
+}
+
+func DefaultWorkspacePool() *workspacePool {
+	if WorkspacesDir == "" {
+		return nil
+	}
+	return NewWorkspacePool(WorkspacesDir, WorkspacesMaxSize*1024*1024, WorkspacesMaxCount)
+}
+
+func NewWorkspacePool(dir string, maxsize int64, maxcount int) *workspacePool {
+	pool := &workspacePool{}
+	pool.dir = dir
+	pool.maxsize = maxsize
+	pool.maxcount = maxcount
+	pool.locks = map[string]*sync.Mutex{}
+	pool.sizes = map[string]int64{}
+	pool.lock = &sync.Mutex{}
+	return pool
+}
+
+// Acquire waits for the workspace of the branch to be free, both within this
+// process and against other processes sharing the workspaces directory, and
+// returns its directory along with the function releasing it.
+func (p *workspacePool) Acquire(repo string, branch string) (string, func(), error) {
+	if repo == "" || branch == "" || strings.Contains(repo, "..") {
+		return "", nil, fmt.Errorf("Invalid workspace %s@%s", repo, branch)
+	}
+	dir := filepath.Join(p.dir, filepath.FromSlash(repo), url.QueryEscape(branch))
+	err := os.MkdirAll(filepath.Dir(dir), 0755)
+	if err != nil {
+		return "", nil, err
+	}
+
+	p.lock.Lock()
+	lock, ok := p.locks[dir]
+	if !ok {
+		lock = &sync.Mutex{}
+		p.locks[dir] = lock
+	}
+	p.lock.Unlock()
+	lock.Lock()
+
+	f, err := lockWorkspace(dir, syscall.LOCK_EX)
+	if err != nil {
+		lock.Unlock()
+		return "", nil, err
+	}
+
+	release := func() {
+		now := time.Now()
+		os.Chtimes(dir, now, now)
+		size, _ := dirSize(dir)
+		p.lock.Lock()
+		p.sizes[dir] = size
+		p.lock.Unlock()
+		unlockWorkspace(f)
+		lock.Unlock()
+		p.evict()
+	}
+	return dir, release, nil
+}
+
+// lockWorkspace takes the flock of the workspace, which is held for as long
+// as a job builds in it.
+func lockWorkspace(dir string, how int) (*os.File, error) {
+	f, err := os.OpenFile(dir+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), how)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func unlockWorkspace(f *os.File) {
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	f.Close()
+}
+
+// diskEntry is a file or directory evicted when least recently used.
+type diskEntry struct {
+	path    string
+	size    int64
+	lastuse time.Time
+}
+
+type entriesByLastUse []diskEntry
+
+func (w entriesByLastUse) Len() int           { return len(w) }
+func (w entriesByLastUse) Swap(i, j int)      { w[i], w[j] = w[j], w[i] }
+func (w entriesByLastUse) Less(i, j int) bool { return w[i].lastuse.Before(w[j].lastuse) }
+
+// evict removes the least recently used workspaces until the pool is within
+// its budget. Workspaces whose lock is held are skipped, and only those not
+// released since jarvis started are walked for their size.
+func (p *workspacePool) evict() {
+	dirs, err := filepath.Glob(filepath.Join(p.dir, "*", "*", "*"))
+	if err != nil {
+		glog.Errorf("Failed to list workspaces: %v", err)
+		return
+	}
+
+	workspaces := []diskEntry{}
+	total := int64(0)
+	for _, dir := range dirs {
+		fi, err := os.Stat(dir)
+		if err != nil || !fi.IsDir() {
+			continue
+		}
+		p.lock.Lock()
+		size, ok := p.sizes[dir]
+		p.lock.Unlock()
+		if !ok {
+			size, _ = dirSize(dir)
+			p.lock.Lock()
+			p.sizes[dir] = size
+			p.lock.Unlock()
+		}
+		total += size
+		workspaces = append(workspaces, diskEntry{dir, size, fi.ModTime()})
+	}
+	sort.Sort(entriesByLastUse(workspaces))
+
+	count := len(workspaces)
+	for _, workspace := range workspaces {
+		if total <= p.maxsize && count <= p.maxcount {
+			return
+		}
+		if p.evictWorkspace(workspace) {
+			total -= workspace.size
+			count--
+		}
+	}
+}
+
+// evictWorkspace removes the workspace unless a job holds its lock.
+func (p *workspacePool) evictWorkspace(workspace diskEntry) bool {
+	f, err := lockWorkspace(workspace.path, syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		return false
+	}
+	defer unlockWorkspace(f)
+
+	glog.Infof("Evicting workspace %s (%d bytes)", workspace.path, workspace.size)
+	err = os.RemoveAll(workspace.path)
+	if err != nil {
+		glog.Errorf("Failed to evict workspace %s: %v", workspace.path, err)
+		return false
+	}
+	p.lock.Lock()
+	delete(p.sizes, workspace.path)
+	p.lock.Unlock()
+	return true
+}
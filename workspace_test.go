@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkspacePoolEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspaces")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	pool := NewWorkspacePool(dir, 1<<30, 1)
+	use := func(branch string) string {
+		workspace, release, err := pool.Acquire("owner/repo", branch)
+		assert.Nil(t, err)
+		assert.Nil(t, os.MkdirAll(workspace, 0755))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(workspace, "build"), []byte("build"), 0644))
+		release()
+		return workspace
+	}
+
+	// The size of a workspace is recorded when it is released
+	first := use("master")
+	assert.Equal(t, int64(len("build")), pool.sizes[first])
+
+	// The least recently used workspace is evicted
+	second := use("feature")
+	_, err = os.Stat(first)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(second)
+	assert.Nil(t, err)
+	assert.NotContains(t, pool.sizes, first)
+
+	// A workspace locked by another process is never evicted
+	f, err := lockWorkspace(second, syscall.LOCK_EX)
+	assert.Nil(t, err)
+	third := use("other")
+	_, err = os.Stat(second)
+	assert.Nil(t, err)
+	_, err = os.Stat(third)
+	assert.True(t, os.IsNotExist(err))
+	unlockWorkspace(f)
+}